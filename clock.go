@@ -17,8 +17,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/aamcrae/clock/hand"
 	"github.com/aamcrae/config"
@@ -26,6 +34,9 @@ import (
 
 var configFile = flag.String("config", "", "Configuration file")
 var port = flag.Int("port", 8080, "Web server port number")
+var stateFile = flag.String("state", "", "File to save and restore the hand state")
+var retries = flag.Int("retries", 3, "Number of attempts to calibrate a hand")
+var stopTimeout = flag.Duration("stoptime", 30*time.Second, "Time allowed for the hands to stop at shutdown")
 
 func main() {
 	flag.Parse()
@@ -35,34 +46,165 @@ func main() {
 	}
 	// Read the configs for each of the hands, and create
 	// a ClockHand for each config that is found.
-	var clock []*hand.ClockHand
-	for _, sect := range []string{"hours", "minutes", "seconds"} {
-		hc, err := hand.Config(conf, sect)
-		if err != nil {
-			log.Printf("Invalid config for %s (%v), skipping", sect, err)
-			continue
+	// If dials are listed, the hands for each dial are
+	// in sections named as dial.hand e.g london.hours
+	// The names of the hands may be listed to add further hands
+	// such as a date hand.
+	dials := []string{""}
+	hands := []string{"hours", "minutes", "seconds"}
+	if s := conf.GetSection("clock"); s != nil {
+		if d := s.Get("dials"); len(d) == 1 {
+			dials = d[0].Tokens
 		}
-		c, err := hand.NewClockHand(hc)
-		if err != nil {
-			log.Fatalf("%s: %v", hc.Name, err)
+		if h := s.Get("hands"); len(h) == 1 {
+			hands = h[0].Tokens
 		}
-		clock = append(clock, c)
 	}
-	// Start the clock hands.
-	for _, c := range clock {
-		go c.Run()
+	// Load any state saved from the last shutdown. The state is removed
+	// once read, so that it is not reused if the clock is not shut down cleanly.
+	var saved *hand.State
+	if *stateFile != "" {
+		saved, err = hand.LoadState(*stateFile)
+		if err == nil {
+			os.Remove(*stateFile)
+		} else if !os.IsNotExist(err) {
+			log.Printf("%s: %v", *stateFile, err)
+		}
+	}
+	var clock []*hand.ClockHand
+	for _, d := range dials {
+		for _, sect := range hands {
+			if d != "" {
+				sect = d + "." + sect
+			}
+			hc, err := hand.Config(conf, sect)
+			if err != nil {
+				log.Printf("Invalid config for %s (%v), skipping", sect, err)
+				continue
+			}
+			c, err := hand.NewClockHand(hc)
+			if err != nil {
+				log.Printf("%s: %v, skipping", hc.Name, err)
+				continue
+			}
+			if saved != nil {
+				if hs, ok := saved.Find(hc.Name); ok {
+					c.Restore(hs)
+				}
+			}
+			clock = append(clock, c)
+		}
 	}
 	if len(clock) == 0 {
 		log.Fatalf("No clock hands to run!")
 	}
+	// Start the clock hands. The hands are stopped at shutdown, and the
+	// context is cancelled if they do not stop in time.
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	failed := make(chan *hand.ClockHand, len(clock))
+	for _, c := range clock {
+		wg.Add(1)
+		go func(c *hand.ClockHand) {
+			defer wg.Done()
+			if err := supervise(ctx, c); err != nil {
+				log.Printf("%v, stopping hand", err)
+				failed <- c
+			}
+		}(c)
+	}
+	var clockHands []*hand.Hand
+	for _, c := range clock {
+		clockHands = append(clockHands, c.Hand)
+	}
 	// Start a status server that can display a clock face reflecting the
 	// status of the clock.
+	var server *http.Server
 	if *port != 0 {
-		var hands []*hand.Hand
-		for _, c := range clock {
-			hands = append(hands, c.Hand)
+		face, err := hand.FaceConfig(conf)
+		if err != nil {
+			log.Printf("Invalid config for face (%v), using default", err)
+		}
+		server, err = hand.ClockServer(*port, clockHands, face)
+		if err != nil {
+			log.Printf("Status server: %v", err)
+		}
+	}
+	// Wait for a signal to shut down, or for all the hands to fail.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	for running := len(clock); running > 0; running-- {
+		select {
+		case s := <-sig:
+			log.Printf("Received %s, shutting down", s)
+			shutdown(server, cancel, &wg, clock, clockHands)
+			return
+		case c := <-failed:
+			c.Close()
+		}
+	}
+	shutdown(server, cancel, &wg, clock, clockHands)
+	log.Fatalf("No clock hands running!")
+}
+
+// supervise runs a clock hand. If the calibration fails, it is retried, and
+// if the encoder fails once the position of the hand is known, the hand is run
+// without it. The hand runs until stopped, and an error is returned if it cannot be run.
+func supervise(ctx context.Context, c *hand.ClockHand) error {
+	for i := 1; ; i++ {
+		err := c.Run(ctx)
+		switch {
+		case err == nil || ctx.Err() != nil:
+			return nil
+		case errors.Is(err, hand.ErrEncoder):
+			// Without a mark, the position of the hand is not known.
+			if n, _ := c.Hand.LastMark(); n == 0 {
+				return err
+			}
+			log.Printf("%v, running %s without encoder", err, c.Hand.Name)
+			if err := c.RunWithoutEncoder(ctx); err != nil && ctx.Err() == nil {
+				return err
+			}
+			return nil
+		case errors.Is(err, hand.ErrCalibrate) && i < *retries:
+			log.Printf("%v, retrying (attempt %d of %d)", err, i+1, *retries)
+		default:
+			return err
+		}
+	}
+}
+
+// shutdown stops the status server and the hands, and saves the state of the hands.
+func shutdown(server *http.Server, cancel context.CancelFunc, wg *sync.WaitGroup, clock []*hand.ClockHand, clockHands []*hand.Hand) {
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		server.Shutdown(ctx)
+		cancel()
+	}
+	// Stop the hands, and wait for any moves in progress to finish.
+	// If the hands take too long to stop, the moves are abandoned.
+	for _, h := range clockHands {
+		h.Stop()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(*stopTimeout):
+		log.Printf("Hands not stopped after %s, abandoning moves", *stopTimeout)
+		cancel()
+		<-stopped
+	}
+	cancel()
+	for _, c := range clock {
+		c.Close()
+	}
+	if *stateFile != "" {
+		if err := hand.SaveState(*stateFile, clockHands); err != nil {
+			log.Printf("%s: %v", *stateFile, err)
 		}
-		hand.ClockServer(*port, hands)
 	}
-	select {}
 }
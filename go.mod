@@ -6,7 +6,7 @@ require (
 	github.com/aamcrae/config v0.0.0-20210127022525-df19d49b2183
 	github.com/aamcrae/gpio v0.0.0-20210218115829-408d25ee3f8a
 	github.com/fogleman/gg v1.3.0
-	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
-	golang.org/x/image v0.0.0-20210607152325-775e3b0c77b9 // indirect
+	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
+	golang.org/x/image v0.0.0-20210607152325-775e3b0c77b9
 	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 )
@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// JSON API for clock status and control.
+
+package hand
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const apiPrefix = "/api/v1/hands"
+
+// HandStatus is the status of a hand as returned by the API.
+type HandStatus struct {
+	Name        string  `json:"name"`
+	Dial        string  `json:"dial"`
+	Kind        string  `json:"kind"`
+	Ticking     bool    `json:"ticking"`
+	Paused      bool    `json:"paused"`
+	Position    int     `json:"position"` // Current position in steps from the top of the dial
+	Offset      int     `json:"offset"`
+	Measured    int     `json:"measured"` // Measured steps per revolution
+	Marks       int     `json:"marks"`
+	Skipped     int     `json:"skipped"`
+	FastForward int     `json:"fast_forward"`
+	Adjusted    int     `json:"adjusted"`
+	Returned    int     `json:"returned"`
+	MarkError   int     `json:"mark_error"`
+	Corrections int     `json:"corrections"`
+	Confidence  float64 `json:"confidence"`
+	CalTime     float64 `json:"calibration_seconds"` // Duration of the last calibration
+}
+
+// Status returns the current status of the hand.
+func (h *Hand) Status() HandStatus {
+	p, m, o := h.Get()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return HandStatus{
+		Name:        h.Name,
+		Dial:        h.Dial,
+		Kind:        h.Kind(),
+		Ticking:     h.Ticking,
+		Paused:      h.paused,
+		Position:    p,
+		Offset:      o,
+		Measured:    m,
+		Marks:       h.Marks,
+		Skipped:     h.Skipped,
+		FastForward: h.FastForward,
+		Adjusted:    h.Adjusted,
+		Returned:    h.Returned,
+		MarkError:   h.MarkError,
+		Corrections: h.Corrections,
+		Confidence:  h.Confidence,
+		CalTime:     h.CalTime.Seconds(),
+	}
+}
+
+// apiHandler serves the JSON API:
+//  GET  /api/v1/hands                     - status of all hands
+//  GET  /api/v1/hands/{name}              - status of a single hand
+//  POST /api/v1/hands/{name}/adjust       - adjust the offset, with a body of {"adjust": steps}
+//  POST /api/v1/hands/{name}/pause        - pause the hand
+//  POST /api/v1/hands/{name}/resume       - resume the hand
+//  POST /api/v1/hands/{name}/recalibrate  - recalibrate the hand
+func apiHandler(clock []*Hand) func(http.ResponseWriter, *http.Request) {
+	hm := make(map[string]*Hand)
+	for _, h := range clock {
+		hm[h.Name] = h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+		if path == "" {
+			if r.Method != http.MethodGet {
+				apiError(w, http.StatusMethodNotAllowed, "%s not allowed", r.Method)
+				return
+			}
+			st := []HandStatus{}
+			for _, h := range clock {
+				st = append(st, h.Status())
+			}
+			apiReply(w, st)
+			return
+		}
+		f := strings.Split(path, "/")
+		h, ok := hm[f[0]]
+		if !ok || len(f) > 2 {
+			apiError(w, http.StatusNotFound, "%s: not found", path)
+			return
+		}
+		if len(f) == 1 {
+			if r.Method != http.MethodGet {
+				apiError(w, http.StatusMethodNotAllowed, "%s not allowed", r.Method)
+				return
+			}
+			apiReply(w, h.Status())
+			return
+		}
+		if r.Method != http.MethodPost {
+			apiError(w, http.StatusMethodNotAllowed, "%s not allowed", r.Method)
+			return
+		}
+		switch f[1] {
+		case "adjust":
+			var req struct {
+				Adjust *int `json:"adjust"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Adjust == nil {
+				apiError(w, http.StatusBadRequest, "expected {\"adjust\": steps}")
+				return
+			}
+			o := h.Adjust(*req.Adjust)
+			log.Printf("%s: Adjusted offset by %d to %d", h.Name, *req.Adjust, o)
+		case "pause":
+			h.Pause()
+		case "resume":
+			h.Resume()
+		case "recalibrate":
+			h.Recalibrate()
+		default:
+			apiError(w, http.StatusNotFound, "%s: unknown command", f[1])
+			return
+		}
+		apiReply(w, h.Status())
+	}
+}
+
+// apiReply writes a JSON response.
+func apiReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("API response: %v", err)
+	}
+}
+
+// apiError writes a JSON error response.
+func apiError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf(format, args...)})
+}
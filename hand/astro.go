@@ -0,0 +1,205 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Astronomical targeting strategies for moon phase and tide hands.
+
+package hand
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// absolute is implemented by a Targeter that uses the absolute time
+// rather than the wall clock time, so that time zones and daylight saving
+// do not apply.
+type absolute interface {
+	absolute()
+}
+
+// Mean length of the lunar synodic month.
+const synodicMonth = time.Duration(29.530588853 * float64(day))
+
+// Reference new moon.
+var newMoon = time.Date(2000, 1, 6, 18, 14, 0, 0, time.UTC)
+
+// moonTarget shows the phase of the moon, with new moon at the top of the dial.
+type moonTarget struct {
+	update time.Duration
+}
+
+func newMoonTarget(hc *ClockConfig) (Targeter, error) {
+	return &moonTarget{update: hc.Update}, nil
+}
+
+func (m *moonTarget) Target(t time.Time) (int64, int64) {
+	pt := t.Sub(newMoon) % synodicMonth
+	if pt < 0 {
+		pt += synodicMonth
+	}
+	return int64(pt / m.update), int64(synodicMonth / m.update)
+}
+
+func (m *moonTarget) Period() time.Duration {
+	return synodicMonth
+}
+
+func (m *moonTarget) Kind() string {
+	return "moon"
+}
+
+func (m *moonTarget) absolute() {}
+
+// Constituent is a single harmonic constituent of a tide model.
+type Constituent struct {
+	Name      string
+	Speed     float64 // Degrees per hour
+	Amplitude float64 // Height
+	Phase     float64 // Phase lag in degrees, relative to tideEpoch
+}
+
+// Speeds of the common tidal constituents, in degrees per hour.
+var constituentSpeeds = map[string]float64{
+	"M2":  28.9841042,
+	"S2":  30.0,
+	"N2":  28.4397295,
+	"K2":  30.0821373,
+	"K1":  15.0410686,
+	"O1":  13.9430356,
+	"P1":  14.9589314,
+	"Q1":  13.3986609,
+	"M4":  57.9682084,
+	"MS4": 58.9841042,
+	"M6":  86.9523127,
+}
+
+// Reference time for the phases of the tide constituents.
+var tideEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Nominal period of the tidal cycle (the period of M2).
+const tidePeriod = 12*time.Hour + 25*time.Minute
+
+// Interval used when searching for high tides.
+const tideSearch = 10 * time.Minute
+
+// ParseTide parses a tide model as a comma separated list
+// of constituents, each as name:amplitude:phase e.g M2:1.2:150.5,S2:0.4:170
+func ParseTide(s string) ([]Constituent, error) {
+	var model []Constituent
+	for _, c := range strings.Split(s, ",") {
+		f := strings.Split(strings.TrimSpace(c), ":")
+		if len(f) != 3 {
+			return nil, fmt.Errorf("%s: expected name:amplitude:phase", c)
+		}
+		speed, ok := constituentSpeeds[strings.ToUpper(f[0])]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown constituent", f[0])
+		}
+		a, err := strconv.ParseFloat(f[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: amplitude: %v", f[0], err)
+		}
+		p, err := strconv.ParseFloat(f[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: phase: %v", f[0], err)
+		}
+		model = append(model, Constituent{Name: f[0], Speed: speed, Amplitude: a, Phase: p})
+	}
+	return model, nil
+}
+
+// tideTarget shows the position within the tidal cycle, with
+// high tide at the top of the dial.
+// The tide is calculated from a harmonic model of the tide for a location.
+// This is a simplified model; the phases are relative to tideEpoch,
+// and nodal corrections are not applied.
+type tideTarget struct {
+	model      []Constituent
+	update     time.Duration
+	mu         sync.Mutex
+	prev, next time.Time // High tides either side of the last time
+}
+
+func newTideTarget(hc *ClockConfig) (Targeter, error) {
+	if len(hc.Tide) == 0 {
+		return nil, fmt.Errorf("tide: no tide model")
+	}
+	return &tideTarget{model: hc.Tide, update: hc.Update}, nil
+}
+
+func (tt *tideTarget) Target(t time.Time) (int64, int64) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if tt.prev.IsZero() || t.Before(tt.prev) || !t.Before(tt.next) {
+		tt.prev = tt.high(t, -tideSearch)
+		tt.next = tt.high(t, tideSearch)
+	}
+	ticks := int64(tidePeriod / tt.update)
+	if !tt.next.After(tt.prev) {
+		return 0, ticks
+	}
+	frac := float64(t.Sub(tt.prev)) / float64(tt.next.Sub(tt.prev))
+	return int64(frac * float64(ticks)), ticks
+}
+
+func (tt *tideTarget) Period() time.Duration {
+	return tidePeriod
+}
+
+func (tt *tideTarget) Kind() string {
+	return "tide"
+}
+
+func (tt *tideTarget) absolute() {}
+
+// rate returns the rate of change of the tide height at time t.
+func (tt *tideTarget) rate(t time.Time) float64 {
+	h := t.Sub(tideEpoch).Hours()
+	var r float64
+	for _, c := range tt.model {
+		r -= c.Amplitude * c.Speed * math.Sin((c.Speed*h-c.Phase)*math.Pi/180)
+	}
+	return r
+}
+
+// high searches from t in steps of step (negative to search backwards)
+// for the time of high tide i.e where the tide changes from rising to falling.
+func (tt *tideTarget) high(t time.Time, step time.Duration) time.Time {
+	for i := 0; i < int(2*tidePeriod/tideSearch); i++ {
+		a := t.Add(step)
+		rising, falling := t, a
+		if step < 0 {
+			rising, falling = a, t
+		}
+		if tt.rate(rising) > 0 && tt.rate(falling) <= 0 {
+			// Bisect to find the turning point.
+			for falling.Sub(rising) > time.Second {
+				mid := rising.Add(falling.Sub(rising) / 2)
+				if tt.rate(mid) > 0 {
+					rising = mid
+				} else {
+					falling = mid
+				}
+			}
+			return falling
+		}
+		t = a
+	}
+	// No high tide found, so use the nominal period.
+	return t
+}
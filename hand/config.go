@@ -15,52 +15,141 @@
 package hand
 
 import (
+	"context"
 	"fmt"
+	"image/color"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aamcrae/config"
 	"github.com/aamcrae/gpio"
-	"github.com/aamcrae/gpio/action"
 )
 
 // Configuration data for the clock hand, usually read from a configuration file.
 type ClockConfig struct {
-	Name    string        // Name of the hand
-	Gpio    []int         // Output pins for the stepper
-	Speed   float64       // Speed the stepper runs at (RPM)
-	Period  time.Duration // Period of the hand (e.g time.Hour)
-	Update  time.Duration // How often the hand updates.
-	Steps   int           // Initial reference steps per revolution
-	Encoder int           // Input pin for encoder
-	Notch   int           // Minimum width of encoder mark
-	Offset  int           // Hand offset from midnight to encoder mark
+	Name        string         // Name of the hand
+	Dial        string         // Name of the dial the hand is part of
+	Type        string         // Type of hand e.g clock, date
+	Driver      string         // Type of stepper driver
+	Sequence    string         // Stepping sequence for unipolar drivers
+	Gpio        []int          // Output pins for the stepper
+	Speed       float64        // Speed the stepper runs at (RPM)
+	Ramp        *Ramp          // Acceleration ramp for moves, nil if none
+	Hold        time.Duration  // Time the motor is held after a move before release, 0 to never release
+	Energise    time.Duration  // Interval to periodically re-energise a released motor, 0 if not used
+	Period      time.Duration  // Period of the hand (e.g time.Hour)
+	Update      time.Duration  // How often the hand updates.
+	Steps       int            // Initial reference steps per revolution
+	Encoder     int            // Input pin for encoder
+	Notch       int            // Minimum width of encoder mark
+	Marks       int            // Number of encoder marks in a revolution
+	Index       int            // Minimum width of encoder index mark, 0 if not distinct
+	Quad        []int          // Input pins for a quadrature encoder
+	CPR         int            // Quadrature encoder counts per revolution
+	Offset      int            // Hand offset from midnight to encoder mark
+	Zone        *time.Location // Time zone that the hand displays
+	Shift       time.Duration  // Offset added to the time displayed
+	Tide        []Constituent  // Tide model for tide hands
+	Arc         float64        // Arc in degrees of a retrograde hand, 0 for a full dial
+	Calibration Calibration    // Calibration mode
+	Park        float64        // Park position in degrees clockwise from the top of the dial
+	Colour      color.Color    // Colour the hand is drawn in, nil for the default
+	Length      float64        // Length the hand is drawn as a fraction of the dial radius, 0 for the default
+	Width       float64        // Width the hand is drawn as a fraction of the dial radius, 0 for the default
 }
 
+// Maximum steps moved before checking whether a move has been cancelled.
+const moveChunk = 32
+
+// Number of moves in each revolution when running a fast calibration.
+const calibrateChunks = 8
+
+// Calibration selects a fast calibration, which stops once the
+// measurements of the steps per revolution have converged.
+type Calibration struct {
+	Count     int     // Number of consecutive measurements that must agree, 0 for a full calibration
+	Tolerance float64 // Allowed spread of the measurements, as a fraction of the mean
+	Max       int     // Maximum number of revolutions
+}
+
+// The allowed error of the encoder mark when verifying a saved state,
+// as a fraction of a revolution.
+const restoreTolerance = 100
+
 // ClockHand combines the I/O for a hand and an encoder.
 // A clock is comprised of multiple hands, each of which runs independently.
 // Each clock hand consists of a Hand which generates move requests according to the current time,
-// an Encoder which provides feedback as to the actual location of the hand,
-// and the I/O providers for the Hand and Encoder.
+// an encoder (either an interrupter Encoder or a QuadEncoder) which provides feedback
+// as to the actual location of the hand, and the I/O providers for the Hand and encoder.
 // A config for each hand is parsed from a configuration file.
 type ClockHand struct {
-	Stepper *action.Stepper
+	Stepper Driver
 	Input   *io.Gpio
+	Quad    [2]*io.Gpio // Quadrature encoder inputs
 	Hand    *Hand
-	Encoder *Encoder
+	Encoder Sensor
 	Config  *ClockConfig
+	moving  sync.Mutex // Held while the motor is moving
+	closed  bool       // Set when the hand is closed
+	saved   *HandState // Saved state to restore, if any
+	stepped int64      // Total motor steps moved, accessed atomically
+	power   power
+}
+
+// power tracks the power state of the motor.
+type power struct {
+	mu        sync.Mutex
+	releaser  Releaser      // Driver that can release the motor, nil if none
+	on        bool          // True if the motor is energised
+	moving    bool          // True if a move is in progress
+	gen       int           // Generation of the timer, to detect stale timers
+	start     time.Time     // Time the accounting started
+	onSince   time.Time     // Time the motor was last energised
+	energised time.Duration // Accumulated time the motor has been energised
 }
 
 // Config reads and validates a ClockHand config from a config file section.
+// Hands may be grouped into separate dials by naming the section as dial.hand
+// (e.g london.hours), in which case the timezone and shift keywords may also be
+// set in a section named for the dial, and apply to all hands on that dial.
 // Sample config:
-//  [name]                   # name of hand e.g hours, minutes, seconds
+//  [name]                   # name of hand e.g hours, minutes, seconds, london.hours
+//  driver=unipolar          # Optional stepper driver: unipolar (default), stepdir or mock
 //  stepper=4,17,27,22,3.0   # GPIOs for stepper motor, and speed in RPM
-//  period=12h               # The clock period for this hand
+//                           # (4 GPIOs for unipolar, STEP,DIR[,ENABLE] for stepdir, none for mock)
+//  sequence=half            # Optional unipolar stepping sequence: half (default), full or wave.
+//                           # Steps, offset and mark widths are in half-steps, and are scaled to suit.
+//  ramp=15.0,20.0,scurve    # Optional acceleration from the stepper speed up to a maximum speed (RPM),
+//                           # with acceleration in RPM per second and an optional profile of
+//                           # trapezoid (default) or scurve
+//  calibrate=3,0.5,8        # Optional fast calibration, stopping when 3 consecutive measurements of the
+//                           # revolution agree within 0.5%, or after at most 8 revolutions
+//  park=180                 # Optional park position in degrees clockwise from the top (default 0)
+//  hold=500ms               # Optional time to hold the motor after a move before turning it off
+//  energise=10m             # Optional interval to briefly re-energise the motor while it is off
+//  type=clock               # Optional type of hand: clock (default), weekday, date, month, moon or tide
+//  tide=M2:1.2:150,S2:0.4:170 # Tide model for tide hands, as constituent:amplitude:phase
+//  period=12h               # The clock period for this hand e.g 1m, 1h, 12h, 24h, 168h
+//                           # (only required for clock hands)
 //  update=5m                # The update rate as a duration
 //  steps=4096               # Reference number of steps in a revolution
 //  encoder=21               # GPIO for encoder
 //  notch=100                # Min width of sensor mark
+//  marks=4,200              # Optional number of encoder marks, and min width of the index mark
+//                           # (required if there is more than one mark)
+//  quadrature=5,6,2400      # Optional quadrature encoder GPIOs and counts per revolution,
+//                           # using the encoder GPIO as the index mark
 //  offset=2100              # The offset of the hand at the encoder mark
+//  arc=270                  # Optional arc in degrees of a retrograde hand
+//  timezone=Europe/London   # Optional time zone, default is the local zone
+//  shift=-30m               # Optional offset added to the time displayed
+//  colour=#0000ff           # Optional colour the hand is drawn in on the status page
+//  length=60                # Optional length the hand is drawn, as a percentage of the dial radius
+//  width=2                  # Optional width the hand is drawn, as a percentage of the dial radius
 func Config(conf *config.Config, name string) (*ClockConfig, error) {
 	s := conf.GetSection(name)
 	if s == nil {
@@ -69,27 +158,112 @@ func Config(conf *config.Config, name string) (*ClockConfig, error) {
 	var err error
 	var h ClockConfig
 	h.Name = name
-	h.Gpio = make([]int, 4)
-	n, err := s.Parse("stepper", "%d,%d,%d,%d,%f", &h.Gpio[0], &h.Gpio[1], &h.Gpio[2], &h.Gpio[3], &h.Speed)
+	if i := strings.LastIndex(name, "."); i > 0 {
+		h.Dial = name[:i]
+	}
+	h.Driver = "unipolar"
+	if d, err := s.GetArg("driver"); err == nil {
+		h.Driver = d
+	}
+	pins, ok := driverPins[h.Driver]
+	if !ok {
+		return nil, fmt.Errorf("driver: unknown driver %s", h.Driver)
+	}
+	st, err := listArg(s, "stepper")
+	if err != nil {
+		return nil, fmt.Errorf("stepper: %v", err)
+	}
+	f := strings.Split(st, ",")
+	h.Speed, err = strconv.ParseFloat(f[len(f)-1], 64)
 	if err != nil {
 		return nil, fmt.Errorf("stepper: %v", err)
 	}
-	if n != 5 {
-		return nil, fmt.Errorf("invalid stepper arguments")
+	for _, v := range f[:len(f)-1] {
+		p, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("stepper: %v", err)
+		}
+		h.Gpio = append(h.Gpio, p)
+	}
+	valid := false
+	for _, n := range pins {
+		valid = valid || n == len(h.Gpio)
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid stepper arguments for %s driver", h.Driver)
 	}
-	n, err = s.Parse("steps", "%d", &h.Steps)
+	if rp, err := listArg(s, "ramp"); err == nil {
+		f := strings.Split(rp, ",")
+		if len(f) < 2 || len(f) > 3 {
+			return nil, fmt.Errorf("ramp: argument count")
+		}
+		h.Ramp = new(Ramp)
+		h.Ramp.Max, err = strconv.ParseFloat(f[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("ramp: %v", err)
+		}
+		h.Ramp.Accel, err = strconv.ParseFloat(f[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("ramp: %v", err)
+		}
+		if h.Ramp.Max <= h.Speed || h.Ramp.Accel <= 0 {
+			return nil, fmt.Errorf("ramp: invalid speed or acceleration")
+		}
+		if len(f) == 3 {
+			switch f[2] {
+			case "trapezoid":
+			case "scurve":
+				h.Ramp.Curve = true
+			default:
+				return nil, fmt.Errorf("ramp: unknown profile %s", f[2])
+			}
+		}
+	}
+	if _, err := listArg(s, "calibrate"); err == nil {
+		var pc float64
+		n, err := s.Parse("calibrate", "%d,%f,%d", &h.Calibration.Count, &pc, &h.Calibration.Max)
+		if err != nil {
+			return nil, fmt.Errorf("calibrate: %v", err)
+		}
+		if n != 3 || h.Calibration.Count < 2 || pc <= 0 || h.Calibration.Max < 1 {
+			return nil, fmt.Errorf("invalid calibrate arguments")
+		}
+		h.Calibration.Tolerance = pc / 100
+	}
+	if hd, err := s.GetArg("hold"); err == nil {
+		h.Hold, err = time.ParseDuration(hd)
+		if err != nil {
+			return nil, fmt.Errorf("hold: %v", err)
+		}
+	}
+	if en, err := s.GetArg("energise"); err == nil {
+		if h.Hold == 0 {
+			return nil, fmt.Errorf("energise: requires hold")
+		}
+		h.Energise, err = time.ParseDuration(en)
+		if err != nil {
+			return nil, fmt.Errorf("energise: %v", err)
+		}
+	}
+	n, err := s.Parse("steps", "%d", &h.Steps)
 	if err != nil {
 		return nil, fmt.Errorf("steps: %v", err)
 	}
 	if n != 1 {
 		return nil, fmt.Errorf("steps: argument count")
 	}
+	h.Type = "clock"
+	if t, err := s.GetArg("type"); err == nil {
+		h.Type = t
+	}
+	if _, ok := targeters[h.Type]; !ok {
+		return nil, fmt.Errorf("type: unknown hand type %s", h.Type)
+	}
 	p, err := s.GetArg("period")
-	if err != nil {
-		return nil, fmt.Errorf("period: %v", err)
+	if err == nil {
+		h.Period, err = time.ParseDuration(p)
 	}
-	h.Period, err = time.ParseDuration(p)
-	if err != nil {
+	if err != nil && h.Type == "clock" {
 		return nil, fmt.Errorf("period: %v", err)
 	}
 	u, err := s.GetArg("update")
@@ -100,6 +274,12 @@ func Config(conf *config.Config, name string) (*ClockConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("update: %v", err)
 	}
+	if h.Update <= 0 {
+		return nil, fmt.Errorf("update: must be greater than 0")
+	}
+	if h.Type == "clock" && h.Period < h.Update {
+		return nil, fmt.Errorf("period: must be at least the update interval")
+	}
 	n, err = s.Parse("encoder", "%d", &h.Encoder)
 	if err != nil {
 		return nil, fmt.Errorf("encoder: %v", err)
@@ -114,6 +294,36 @@ func Config(conf *config.Config, name string) (*ClockConfig, error) {
 	if n != 1 {
 		return nil, fmt.Errorf("notch: argument count")
 	}
+	h.Marks = 1
+	if m, err := listArg(s, "marks"); err == nil {
+		f := strings.Split(m, ",")
+		if len(f) > 2 {
+			return nil, fmt.Errorf("marks: argument count")
+		}
+		h.Marks, err = strconv.Atoi(f[0])
+		if err != nil || h.Marks < 1 {
+			return nil, fmt.Errorf("marks: invalid number of marks")
+		}
+		if len(f) == 2 {
+			h.Index, err = strconv.Atoi(f[1])
+			if err != nil || h.Index <= h.Notch {
+				return nil, fmt.Errorf("marks: index width must be greater than notch")
+			}
+		} else if h.Marks > 1 {
+			// The offset is relative to the index mark, so it must be identifiable.
+			return nil, fmt.Errorf("marks: index width required for more than one mark")
+		}
+	}
+	if _, err := listArg(s, "quadrature"); err == nil {
+		h.Quad = make([]int, 2)
+		n, err = s.Parse("quadrature", "%d,%d,%d", &h.Quad[0], &h.Quad[1], &h.CPR)
+		if err != nil {
+			return nil, fmt.Errorf("quadrature: %v", err)
+		}
+		if n != 3 || h.CPR <= 0 {
+			return nil, fmt.Errorf("invalid quadrature arguments")
+		}
+	}
 	n, err = s.Parse("offset", "%d", &h.Offset)
 	if err != nil {
 		return nil, fmt.Errorf("offset: %v", err)
@@ -121,23 +331,178 @@ func Config(conf *config.Config, name string) (*ClockConfig, error) {
 	if n != 1 {
 		return nil, fmt.Errorf("offset: argument count")
 	}
+	h.Sequence = "half"
+	if sq, err := s.GetArg("sequence"); err == nil {
+		if h.Driver != "unipolar" {
+			return nil, fmt.Errorf("sequence: only valid for unipolar driver")
+		}
+		h.Sequence = sq
+	}
+	seq, ok := sequences[h.Sequence]
+	if !ok {
+		return nil, fmt.Errorf("sequence: unknown sequence %s", h.Sequence)
+	}
+	// Scale the step counts to suit the sequence.
+	h.Steps /= seq.scale
+	h.Offset /= seq.scale
+	h.Notch /= seq.scale
+	h.Index /= seq.scale
+	h.Zone = time.Local
+	if tz, err := dialArg(conf, s, h.Dial, "timezone"); err == nil {
+		h.Zone, err = time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("timezone: %v", err)
+		}
+	}
+	if a, err := s.GetArg("arc"); err == nil {
+		h.Arc, err = strconv.ParseFloat(a, 64)
+		if err != nil {
+			return nil, fmt.Errorf("arc: %v", err)
+		}
+		if h.Arc <= 0 || h.Arc >= 360 {
+			return nil, fmt.Errorf("arc: must be between 0 and 360 degrees")
+		}
+	}
+	if h.Type == "tide" {
+		t, err := listArg(s, "tide")
+		if err != nil {
+			return nil, fmt.Errorf("tide: %v", err)
+		}
+		h.Tide, err = ParseTide(t)
+		if err != nil {
+			return nil, fmt.Errorf("tide: %v", err)
+		}
+	}
+	if p, err := s.GetArg("park"); err == nil {
+		h.Park, err = strconv.ParseFloat(p, 64)
+		if err != nil {
+			return nil, fmt.Errorf("park: %v", err)
+		}
+		if h.Park < 0 || h.Park >= 360 {
+			return nil, fmt.Errorf("park: must be between 0 and 360 degrees")
+		}
+	}
+	if sh, err := dialArg(conf, s, h.Dial, "shift"); err == nil {
+		h.Shift, err = time.ParseDuration(sh)
+		if err != nil {
+			return nil, fmt.Errorf("shift: %v", err)
+		}
+	}
+	if c, err := s.GetArg("colour"); err == nil {
+		h.Colour, err = parseColour(c)
+		if err != nil {
+			return nil, fmt.Errorf("colour: %v", err)
+		}
+	}
+	if l, err := s.GetArg("length"); err == nil {
+		h.Length, err = parsePercent(l, 100)
+		if err != nil {
+			return nil, fmt.Errorf("length: %v", err)
+		}
+	}
+	if w, err := s.GetArg("width"); err == nil {
+		h.Width, err = parsePercent(w, 20)
+		if err != nil {
+			return nil, fmt.Errorf("width: %v", err)
+		}
+	}
 	return &h, nil
 }
 
+// FaceConfig reads the clock face used by the status server from the face
+// section of the config file. nil is returned if there is no face section.
+// Sample config:
+//  [face]
+//  image=/etc/dial.jpg      # Optional clock face image, default is the clockface flag.
+//                           # If the image is not found, the built-in face is used.
+//  centre=641,646           # Optional centre of the dial in the image, default is the centre of the image
+//  radius=640               # Optional radius of the dial in the image, default fits the image
+func FaceConfig(conf *config.Config) (*Face, error) {
+	s := conf.GetSection("face")
+	if s == nil {
+		return nil, nil
+	}
+	f := &Face{Image: *clockface}
+	if i, err := s.GetArg("image"); err == nil {
+		f.Image = i
+	}
+	if s.Has("centre") {
+		n, err := s.Parse("centre", "%f,%f", &f.X, &f.Y)
+		if err != nil {
+			return nil, fmt.Errorf("centre: %v", err)
+		}
+		if n != 2 {
+			return nil, fmt.Errorf("centre: argument count")
+		}
+		if f.X <= 0 || f.Y <= 0 {
+			return nil, fmt.Errorf("centre: must be within the image")
+		}
+	}
+	if r, err := s.GetArg("radius"); err == nil {
+		f.Radius, err = strconv.ParseFloat(r, 64)
+		if err != nil {
+			return nil, fmt.Errorf("radius: %v", err)
+		}
+		if f.Radius <= 0 {
+			return nil, fmt.Errorf("radius: must be greater than 0")
+		}
+	}
+	return f, nil
+}
+
+// listArg returns the value of a keyword that may be a comma separated list.
+// The config parser splits the value into tokens at each comma, so GetArg
+// cannot be used for these keywords.
+func listArg(s *config.Section, key string) (string, error) {
+	e := s.Get(key)
+	if len(e) != 1 {
+		return "", fmt.Errorf("missing or duplicate keyword: %s", key)
+	}
+	return e[0].Args, nil
+}
+
+// dialArg returns the value of a keyword from the hand section, or if it is not
+// present there, from the section of the dial that the hand belongs to.
+func dialArg(conf *config.Config, s *config.Section, dial, key string) (string, error) {
+	v, err := s.GetArg(key)
+	if err == nil || dial == "" {
+		return v, err
+	}
+	ds := conf.GetSection(dial)
+	if ds == nil {
+		return v, err
+	}
+	return ds.GetArg(key)
+}
+
 // NewClockHand initialises the I/O, Hand, and Encoder using the configuration provided.
 func NewClockHand(hc *ClockConfig) (*ClockHand, error) {
 	c := new(ClockHand)
 	c.Config = hc
-	var gp [4]*io.Gpio
-	var err error
-	for i, v := range hc.Gpio {
-		gp[i], err = io.OutputPin(v)
-		if err != nil {
-			return nil, fmt.Errorf("Pin %d: %v", v, err)
-		}
+	tg, err := NewTargeter(hc)
+	if err != nil {
+		return nil, err
+	}
+	c.Stepper, err = NewDriver(hc)
+	if err != nil {
+		return nil, err
+	}
+	c.power.start = time.Now()
+	c.power.onSince = c.power.start
+	c.power.on = true
+	if r, ok := c.Stepper.(Releaser); ok && hc.Hold != 0 {
+		c.power.releaser = r
+	} else if hc.Hold != 0 {
+		log.Printf("%s: driver cannot release motor, hold ignored", hc.Name)
 	}
-	c.Stepper = action.NewStepper(hc.Steps, gp[0], gp[1], gp[2], gp[3])
-	c.Hand = NewHand(hc.Name, hc.Period, c, hc.Update, int(hc.Steps), hc.Offset)
+	c.Hand = NewHand(hc.Name, RealTime, tg, c, hc.Update, int(hc.Steps), hc.Offset)
+	c.Hand.Dial = hc.Dial
+	c.Hand.SetLocation(hc.Zone, hc.Shift)
+	if hc.Arc != 0 {
+		c.Hand.SetArc(hc.Arc)
+	}
+	c.Hand.SetPark(hc.Park)
+	c.Hand.SetStyle(hc.Colour, hc.Length, hc.Width)
 	c.Input, err = io.Pin(hc.Encoder)
 	if err != nil {
 		c.Close()
@@ -148,27 +513,232 @@ func NewClockHand(hc *ClockConfig) (*ClockHand, error) {
 		c.Close()
 		return nil, fmt.Errorf("Encoder %d: %v", hc.Encoder, err)
 	}
-	c.Encoder = NewEncoder(hc.Name, c.Stepper, c.Hand, c.Input, hc.Notch)
+	if hc.CPR == 0 {
+		c.Encoder = NewEncoder(hc.Name, c.Stepper, c.Hand, c.Input, hc.Notch, hc.Marks, hc.Index)
+		return c, nil
+	}
+	for i, v := range hc.Quad {
+		c.Quad[i], err = io.Pin(v)
+		if err == nil {
+			err = c.Quad[i].Edge(io.BOTH)
+		}
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("Quadrature %d: %v", v, err)
+		}
+	}
+	c.Encoder = NewQuadEncoder(hc.Name, c.Stepper, c.Hand, c.Quad[0], c.Quad[1], c.Input, hc.CPR)
 	return c, nil
 }
 
 // Run starts the clock hand, initially running a calibration so that
 // the encoder mark position can be discovered, and then starting the
 // hand processing if requested.
-func (c *ClockHand) Run() {
-	Calibrate(true, c.Encoder, c.Hand, c.Config.Steps)
+// If a saved state has been restored and can be verified, the calibration is skipped.
+// If the hand is stopped, the verification or calibration is abandoned and nil is returned.
+func (c *ClockHand) Run(ctx context.Context) error {
+	if c.saved != nil {
+		vctx, cancel := c.Hand.stopContext(ctx)
+		ok, err := c.verify(vctx, *c.saved)
+		cancel()
+		if c.Hand.isStopped() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.saved = nil
+		if ok {
+			if err := runHand(ctx, c.Encoder, c.Hand); err != errRecalibrate {
+				return err
+			}
+		}
+	}
+	return Calibrate(ctx, true, c.Encoder, c.Hand, c.Config.Steps, c.Config.Calibration)
+}
+
+// RunWithoutEncoder runs the hand without the encoder, e.g after the encoder has failed.
+// The hand cannot be recalibrated, so recalibration requests are ignored.
+func (c *ClockHand) RunWithoutEncoder(ctx context.Context) error {
+	for {
+		if err := c.Hand.Run(ctx); err != errRecalibrate {
+			return err
+		}
+		log.Printf("%s: Cannot recalibrate without encoder", c.Hand.Name)
+	}
 }
 
-// Move moves the stepper motor the steps indicated. This is a
+// Restore sets a saved state for the hand, which is verified when the hand is run.
+func (c *ClockHand) Restore(hs HandState) {
+	c.saved = &hs
+}
+
+// verify restores the saved state of the hand, and then moves the hand
+// past the next encoder mark to check that the mark is where it is expected
+// to be. If the saved state is not valid, the encoder is reset and false is returned.
+func (c *ClockHand) verify(ctx context.Context, hs HandState) (bool, error) {
+	seeder, ok := c.Encoder.(Seeder)
+	if !ok {
+		return false, nil
+	}
+	ref := c.Config.Steps
+	if hs.Measured < ref-ref/10 || hs.Measured > ref+ref/10 || hs.Position < 0 || hs.Position >= hs.Measured {
+		log.Printf("%s: Invalid saved state (measured %d, position %d)", c.Hand.Name, hs.Measured, hs.Position)
+		return false, nil
+	}
+	log.Printf("%s: Restoring saved state (measured %d, offset %d, position %d)", c.Hand.Name, hs.Measured, hs.Offset, hs.Position)
+	c.Hand.Restore(hs)
+	seeder.Seed(hs.Measured, c.GetLocation()-int64(hs.Position))
+	// Move to just past the next mark.
+	marks := c.Config.Marks
+	if c.Config.CPR != 0 || marks < 1 {
+		marks = 1
+	}
+	spacing := hs.Measured / marks
+	tolerance := hs.Measured / restoreTolerance
+	seen, _ := c.Hand.LastMark()
+	if err := c.Move(ctx, spacing-hs.Position%spacing+tolerance); err != nil {
+		return false, err
+	}
+	n, e := c.Hand.LastMark()
+	if n == seen {
+		log.Printf("%s: Mark not seen, saved state discarded", c.Hand.Name)
+	} else if e > tolerance || e < -tolerance {
+		log.Printf("%s: Mark error %d steps, saved state discarded", c.Hand.Name, e)
+	} else {
+		log.Printf("%s: Saved state verified (mark error %d steps)", c.Hand.Name, e)
+		return true, nil
+	}
+	seeder.Seed(0, 0)
+	return false, nil
+}
+
+// Move moves the stepper motor the steps indicated, with negative
+// steps moving counter-clockwise. This is a
 // shim between the hand and the stepper so that the motor can be
 // turned off between movements. Waits until the motor completes the
 // steps before returning.
-// TODO: Turning the motor off immediately will miss steps under load, so
-// some kind of delay is needed.
-func (c *ClockHand) Move(steps int) {
-	if c.Stepper != nil {
-		c.Stepper.Step(c.Config.Speed, steps)
-		c.Stepper.Wait()
+// If a ramp is configured, the motor accelerates and decelerates
+// so that large moves can run faster without missing steps.
+// Turning the motor off immediately will miss steps under load, so
+// the motor is held for a configured time before it is released.
+// The move is stopped early if the context is cancelled.
+func (c *ClockHand) Move(ctx context.Context, steps int) error {
+	if c.Stepper == nil {
+		return nil
+	}
+	c.moving.Lock()
+	defer c.moving.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	c.power.mu.Lock()
+	c.power.moving = true
+	c.power.gen++ // Cancel any pending timer
+	c.energise()
+	c.power.mu.Unlock()
+	defer func() {
+		c.power.mu.Lock()
+		c.power.moving = false
+		c.schedule(c.Config.Hold, c.release)
+		c.power.mu.Unlock()
+	}()
+	segs := []segment{{c.Config.Speed, steps}}
+	if c.Config.Ramp != nil {
+		segs = c.Config.Ramp.profile(c.Config.Speed, steps, c.Config.Steps)
+	}
+	// Step in chunks so that the move can be interrupted.
+	for _, sg := range segs {
+		for sg.steps != 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			n := sg.steps
+			if n > moveChunk {
+				n = moveChunk
+			} else if n < -moveChunk {
+				n = -moveChunk
+			}
+			c.Stepper.Step(sg.rpm, n)
+			c.Stepper.Wait()
+			sg.steps -= n
+			if n < 0 {
+				n = -n
+			}
+			atomic.AddInt64(&c.stepped, int64(n))
+		}
+	}
+	return nil
+}
+
+// Stepped returns the total number of motor steps moved.
+func (c *ClockHand) Stepped() int64 {
+	return atomic.LoadInt64(&c.stepped)
+}
+
+// Edges returns the number of encoder input edges seen, or
+// 0 if the encoder does not count them.
+func (c *ClockHand) Edges() int64 {
+	if ec, ok := c.Encoder.(edgeCounter); ok {
+		return ec.Edges()
+	}
+	return 0
+}
+
+// Energised returns the time the motor has been energised, and
+// the total time since the hand was started.
+func (c *ClockHand) Energised() (time.Duration, time.Duration) {
+	c.power.mu.Lock()
+	defer c.power.mu.Unlock()
+	now := time.Now()
+	on := c.power.energised
+	if c.power.on {
+		on += now.Sub(c.power.onSince)
+	}
+	return on, now.Sub(c.power.start)
+}
+
+// schedule starts a timer to call f after the delay. The function is
+// not called if the motor is moved before the timer expires.
+// Must be called with the power lock held, and f is called with the lock held.
+func (c *ClockHand) schedule(d time.Duration, f func()) {
+	if c.power.releaser == nil {
+		return
+	}
+	c.power.gen++
+	gen := c.power.gen
+	time.AfterFunc(d, func() {
+		c.power.mu.Lock()
+		defer c.power.mu.Unlock()
+		if gen == c.power.gen && !c.power.moving {
+			f()
+		}
+	})
+}
+
+// energise turns the motor on. Must be called with the power lock held.
+func (c *ClockHand) energise() {
+	if c.power.releaser != nil && !c.power.on {
+		c.power.releaser.Energise()
+		c.power.on = true
+		c.power.onSince = time.Now()
+	}
+}
+
+// release turns the motor off, and if configured, schedules a
+// periodic re-energise of the motor so that it is pulled back to the
+// current step if it has drifted. Must be called with the power lock held.
+func (c *ClockHand) release() {
+	if c.power.on {
+		c.power.releaser.Release()
+		c.power.on = false
+		c.power.energised += time.Now().Sub(c.power.onSince)
+	}
+	if c.Config.Energise != 0 {
+		c.schedule(c.Config.Energise, func() {
+			c.energise()
+			c.schedule(c.Config.Hold, c.release)
+		})
 	}
 }
 
@@ -178,26 +748,151 @@ func (c *ClockHand) GetLocation() int64 {
 }
 
 // Close shuts down the clock hand and release the resources.
+// Close waits for any move in progress to end, and turns the motor off.
+// To let the moves of a running hand complete, stop the hand before closing it.
 func (c *ClockHand) Close() {
+	c.moving.Lock()
+	defer c.moving.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.power.mu.Lock()
+	c.power.gen++ // Cancel any pending timer
+	c.power.mu.Unlock()
 	if c.Stepper != nil {
 		c.Stepper.Close()
 	}
 	if c.Input != nil {
 		c.Input.Close()
 	}
+	for _, q := range c.Quad {
+		if q != nil {
+			q.Close()
+		}
+	}
+}
+
+// Calibrate moves the hand to allow the encoder to measure the actual
+// steps for 360 degrees of movement, and to discover the location of the encoder mark.
+// A full calibration moves the hand at least 4 revolutions. A fast calibration
+// stops once the last measurements of the revolution agree within a tolerance,
+// or when the maximum number of revolutions has been reached.
+// The confidence in the measurement is recorded in the hand.
+// ErrCalibrate is returned if the encoder mark is not seen, or
+// ErrEncoder if the encoder has failed.
+// If run is set, the hand is run after calibration, and is recalibrated if requested.
+// If the context is cancelled, the context error is returned, and
+// if the hand is stopped, the calibration is abandoned and nil is returned.
+func Calibrate(ctx context.Context, run bool, e Sensor, h *Hand, reference int, cal Calibration) error {
+	for {
+		cctx, cancel := h.stopContext(ctx)
+		err := calibrate(cctx, e, h, reference, cal)
+		cancel()
+		if h.isStopped() {
+			return nil
+		}
+		if err != nil || !run {
+			return err
+		}
+		if err := runHand(ctx, e, h); err != errRecalibrate {
+			return err
+		}
+	}
+}
+
+// runHand runs the hand until it stops. If the sensor reports a failure
+// while the hand is running, the hand is stopped and the failure is returned.
+func runHand(ctx context.Context, e Sensor, h *Hand) error {
+	r, ok := e.(ErrorReporter)
+	if !ok {
+		return h.Run(ctx)
+	}
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- h.Run(rctx) }()
+	select {
+	case err := <-done:
+		return err
+	case err := <-r.Errors():
+		cancel()
+		<-done
+		return err
+	}
 }
 
-// Calibrate moves the hand at least 4 revolutions to allow
-// the encoder to measure the actual steps for 360 degrees of movement, and
-// to discover the location of the encoder mark.
-func Calibrate(run bool, e *Encoder, h *Hand, reference int) {
+// calibrate runs a single calibration of the hand.
+func calibrate(ctx context.Context, e Sensor, h *Hand, reference int, cal Calibration) error {
 	log.Printf("%s: Starting calibration", h.Name)
-	h.mover.Move(int(reference*4 + reference/2))
-	if e.Measured == 0 {
-		log.Fatalf("Unable to calibrate")
+	start := time.Now()
+	// Only use the measurements made during this calibration.
+	if iv, ok := e.(Intervals); ok {
+		iv.ClearIntervals()
 	}
-	log.Printf("%s: Calibration complete (%d steps), encoder: %d", h.Name, e.Measured, e.Location())
-	if run {
-		h.Run()
+	if cal.Count == 0 {
+		if err := h.mover.Move(ctx, int(reference*4+reference/2)); err != nil {
+			return err
+		}
+	} else {
+		// Move in small increments, checking the measurements after each.
+		// Move at least a step at a time, so that a small reference still progresses.
+		chunk := reference / calibrateChunks
+		if chunk < 1 {
+			chunk = 1
+		}
+		for moved := 0; moved < cal.Max*reference; moved += chunk {
+			if err := h.mover.Move(ctx, chunk); err != nil {
+				return err
+			}
+			if c, ok := confidence(e, cal.Count); ok && c >= 1-cal.Tolerance {
+				break
+			}
+		}
+	}
+	if r, ok := e.(ErrorReporter); ok {
+		select {
+		case err := <-r.Errors():
+			return err
+		default:
+		}
+	}
+	if e.Measured() == 0 {
+		return fmt.Errorf("%s: %w, encoder mark not seen", h.Name, ErrCalibrate)
+	}
+	h.mu.Lock()
+	h.Confidence, _ = confidence(e, cal.Count)
+	h.CalTime = time.Since(start)
+	h.mu.Unlock()
+	log.Printf("%s: Calibration complete (%d steps, confidence %.4f), encoder: %d", h.Name, e.Measured(), h.Confidence, e.Location())
+	return nil
+}
+
+// confidence returns a measure of how well the last n measurements of the
+// revolution agree, as 1 - spread/mean, and whether there are enough measurements.
+// If n is 0, all the measurements are used.
+func confidence(e Sensor, n int) (float64, bool) {
+	iv, ok := e.(Intervals)
+	if !ok {
+		return 0, false
+	}
+	m := iv.Intervals()
+	if n == 0 {
+		n = len(m)
+	}
+	if n == 0 || len(m) < n {
+		return 0, false
+	}
+	m = m[len(m)-n:]
+	min, max, sum := m[0], m[0], 0
+	for _, v := range m {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+		sum += v
 	}
+	return 1 - float64(max-min)*float64(n)/float64(sum), true
 }
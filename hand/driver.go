@@ -0,0 +1,287 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Stepper motor drivers.
+
+package hand
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/aamcrae/gpio"
+)
+
+// Driver is the interface to a stepper motor driver.
+// Step starts a movement of the selected number of steps at the speed
+// selected (in RPM), with negative steps moving counter-clockwise,
+// and Wait waits until the movement has completed.
+type Driver interface {
+	Step(float64, int)
+	Wait()
+	GetStep() int64 // Get current absolute location
+	Close()
+}
+
+// Releaser is implemented by drivers that can turn off the motor
+// between movements. Energise turns the motor back on, holding
+// the current step.
+type Releaser interface {
+	Release()
+	Energise()
+}
+
+// Number of GPIOs required for each type of driver.
+var driverPins = map[string][]int{
+	"unipolar": {4},
+	"stepdir":  {2, 3},
+	"mock":     {0},
+}
+
+// Stepping sequences for unipolar motors. The step counts in the config
+// are in half-steps, so they are scaled for the other sequences.
+var sequences = map[string]struct {
+	seq   [][]int
+	scale int
+}{
+	"half": {[][]int{{1, 0, 0, 0}, {1, 1, 0, 0}, {0, 1, 0, 0}, {0, 1, 1, 0}, {0, 0, 1, 0}, {0, 0, 1, 1}, {0, 0, 0, 1}, {1, 0, 0, 1}}, 1},
+	"full": {[][]int{{1, 1, 0, 0}, {0, 1, 1, 0}, {0, 0, 1, 1}, {1, 0, 0, 1}}, 2},
+	"wave": {[][]int{{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}, {0, 0, 0, 1}}, 2},
+}
+
+// NewDriver creates the stepper motor driver selected in the config.
+func NewDriver(hc *ClockConfig) (Driver, error) {
+	var gp []*io.Gpio
+	for _, v := range hc.Gpio {
+		p, err := io.OutputPin(v)
+		if err != nil {
+			for _, o := range gp {
+				o.Close()
+			}
+			return nil, fmt.Errorf("Pin %d: %v", v, err)
+		}
+		gp = append(gp, p)
+	}
+	switch hc.Driver {
+	case "unipolar":
+		return NewUnipolar(hc.Steps, sequences[hc.Sequence].seq, gp[0], gp[1], gp[2], gp[3]), nil
+	case "stepdir":
+		return NewStepDir(hc.Steps, gp[0], gp[1], gp[2:]...), nil
+	case "mock":
+		return NewMockDriver(hc.Steps), nil
+	}
+	return nil, fmt.Errorf("%s: unknown driver", hc.Driver)
+}
+
+// stepDelay returns the delay between steps for the speed selected.
+func stepDelay(rpm float64, steps int) time.Duration {
+	return time.Duration(float64(time.Minute) / (rpm * float64(steps)))
+}
+
+// Unipolar is a driver for 4 wire unipolar stepper motors (such as the 28BYJ-48)
+// using a selected stepping sequence.
+// Moves are performed synchronously by Step.
+type Unipolar struct {
+	pins  [4]*io.Gpio
+	seq   [][]int // Stepping sequence
+	steps int     // Steps per revolution
+	index int     // Current index into the sequence
+	out   []int   // Current output values
+	loc   int64   // Current location, accessed atomically
+}
+
+// NewUnipolar creates a Unipolar driver using the stepping sequence provided.
+func NewUnipolar(steps int, seq [][]int, p1, p2, p3, p4 *io.Gpio) *Unipolar {
+	return &Unipolar{pins: [4]*io.Gpio{p1, p2, p3, p4}, seq: seq, steps: steps, out: []int{-1, -1, -1, -1}}
+}
+
+// Step moves the motor the number of steps at the speed selected.
+func (u *Unipolar) Step(rpm float64, steps int) {
+	inc := 1
+	if steps < 0 {
+		inc = -1
+		steps = -steps
+	}
+	delay := stepDelay(rpm, u.steps)
+	next := time.Now()
+	for i := 0; i < steps; i++ {
+		u.index = (u.index + inc + len(u.seq)) % len(u.seq)
+		u.output(u.seq[u.index])
+		atomic.AddInt64(&u.loc, int64(inc))
+		next = next.Add(delay)
+		time.Sleep(time.Until(next))
+	}
+}
+
+// output sets the pins that have changed.
+func (u *Unipolar) output(v []int) {
+	for i, p := range u.pins {
+		if u.out[i] != v[i] {
+			p.Set(v[i])
+			u.out[i] = v[i]
+		}
+	}
+}
+
+// Wait returns immediately, since Step is synchronous.
+func (u *Unipolar) Wait() {
+}
+
+// Release turns off the motor coils.
+func (u *Unipolar) Release() {
+	u.output([]int{0, 0, 0, 0})
+}
+
+// Energise turns on the motor coils at the current step.
+func (u *Unipolar) Energise() {
+	u.output(u.seq[u.index])
+}
+
+// GetStep returns the current absolute location.
+func (u *Unipolar) GetStep() int64 {
+	return atomic.LoadInt64(&u.loc)
+}
+
+// Close turns off the motor and releases the pins.
+func (u *Unipolar) Close() {
+	u.output([]int{0, 0, 0, 0})
+	for _, p := range u.pins {
+		p.Close()
+	}
+}
+
+// StepDir is a driver for STEP/DIR stepper motor controllers such as
+// the A4988 or DRV8825, with an optional (active low) enable pin.
+// Moves are performed synchronously by Step.
+type StepDir struct {
+	step, dir *io.Gpio
+	enable    *io.Gpio
+	steps     int   // Steps per revolution
+	loc       int64 // Current location, accessed atomically
+}
+
+// NewStepDir creates a StepDir driver using the STEP and DIR pins, and
+// an optional enable pin.
+func NewStepDir(steps int, step, dir *io.Gpio, enable ...*io.Gpio) *StepDir {
+	s := &StepDir{step: step, dir: dir, steps: steps}
+	if len(enable) > 0 {
+		s.enable = enable[0]
+		s.enable.Set(0)
+	}
+	return s
+}
+
+// Step moves the motor the number of steps at the speed selected.
+func (s *StepDir) Step(rpm float64, steps int) {
+	inc := int64(1)
+	if steps < 0 {
+		inc = -1
+		steps = -steps
+		s.dir.Set(1)
+	} else {
+		s.dir.Set(0)
+	}
+	delay := stepDelay(rpm, s.steps)
+	next := time.Now()
+	for i := 0; i < steps; i++ {
+		s.step.Set(1)
+		s.step.Set(0)
+		atomic.AddInt64(&s.loc, inc)
+		next = next.Add(delay)
+		time.Sleep(time.Until(next))
+	}
+}
+
+// Wait returns immediately, since Step is synchronous.
+func (s *StepDir) Wait() {
+}
+
+// Release disables the driver, if there is an enable pin.
+func (s *StepDir) Release() {
+	if s.enable != nil {
+		s.enable.Set(1)
+	}
+}
+
+// Energise enables the driver, if there is an enable pin.
+func (s *StepDir) Energise() {
+	if s.enable != nil {
+		s.enable.Set(0)
+	}
+}
+
+// GetStep returns the current absolute location.
+func (s *StepDir) GetStep() int64 {
+	return atomic.LoadInt64(&s.loc)
+}
+
+// Close disables the driver and releases the pins.
+func (s *StepDir) Close() {
+	if s.enable != nil {
+		s.enable.Set(1)
+		s.enable.Close()
+	}
+	s.step.Close()
+	s.dir.Close()
+}
+
+// MockDriver is a driver that has no hardware, but tracks the location and
+// takes the same time to move as a real motor.
+type MockDriver struct {
+	steps int   // Steps per revolution
+	loc   int64 // Current location, accessed atomically
+}
+
+// NewMockDriver creates a MockDriver.
+func NewMockDriver(steps int) *MockDriver {
+	return &MockDriver{steps: steps}
+}
+
+// Step moves the location the number of steps at the speed selected.
+func (m *MockDriver) Step(rpm float64, steps int) {
+	inc := int64(1)
+	if steps < 0 {
+		inc = -1
+		steps = -steps
+	}
+	delay := stepDelay(rpm, m.steps)
+	next := time.Now()
+	for i := 0; i < steps; i++ {
+		atomic.AddInt64(&m.loc, inc)
+		next = next.Add(delay)
+		time.Sleep(time.Until(next))
+	}
+}
+
+// Wait returns immediately, since Step is synchronous.
+func (m *MockDriver) Wait() {
+}
+
+// Release does nothing.
+func (m *MockDriver) Release() {
+}
+
+// Energise does nothing.
+func (m *MockDriver) Energise() {
+}
+
+// GetStep returns the current absolute location.
+func (m *MockDriver) GetStep() int64 {
+	return atomic.LoadInt64(&m.loc)
+}
+
+// Close does nothing.
+func (m *MockDriver) Close() {
+}
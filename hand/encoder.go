@@ -17,7 +17,11 @@
 package hand
 
 import (
+	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // GetStep provides a method to read the absolute location of the stepper motor.
@@ -25,10 +29,40 @@ type GetStep interface {
 	GetStep() int64
 }
 
-// Syncer provides an interface for a callback when the encoder mark is hit.
-// The measured steps in a revolution is provided.
+// Syncer provides an interface for a callback when an encoder mark is hit.
+// The measured steps in a revolution is provided, along with the
+// absolute location of the mark, and the position of the mark
+// as steps from the index mark.
 type Syncer interface {
-	Mark(int, int64)
+	Mark(int, int64, int)
+}
+
+// Corrector is implemented by syncers that accept corrections of the location
+// that are not from an encoder mark, with the absolute location and the position
+// as steps from the index mark. Syncers that do not implement it are sent a Mark instead.
+type Corrector interface {
+	Correct(int64, int)
+}
+
+// Sensor provides feedback of the physical location of a hand.
+type Sensor interface {
+	Location() int // Current location as steps from the index mark
+	Measured() int // Measured steps per revolution, or 0 if not yet measured
+}
+
+// Seeder is implemented by sensors that can be initialised from a saved state,
+// with the measured steps per revolution and the absolute location of the index mark,
+// so that the marks can be identified without a full calibration.
+// A measured value of 0 clears the saved state.
+type Seeder interface {
+	Seed(int, int64)
+}
+
+// Intervals is implemented by sensors that keep a history of the
+// raw measurements of the steps per revolution, most recent last.
+type Intervals interface {
+	Intervals() []int
+	ClearIntervals()
 }
 
 // IO provides a method to return when an input changes.
@@ -39,96 +73,270 @@ type IO interface {
 const debounce = 5
 const mAvgCount = 5
 
+// Number of raw measurements kept in the interval history.
+const histSize = 10
+
 // Encoder is an interrupter encoder driver used to measure shaft rotations.
 // The count of current step values is used to track the
 // number of steps in a rotation between encoder signals, and
 // this is used to calculate the actual number of steps in a revolution.
+// The direction of movement is tracked from the step values, so that
+// the mark can be detected whichever way the shaft is turning.
+//
+// The encoder may have a number of evenly spaced marks, so that the location
+// can be corrected several times a revolution. One of the marks is the index
+// mark, which is made wider than the others so that it can be identified.
+// If the marks are all the same width, they cannot be identified until the
+// encoder is seeded with the location of the index mark from a saved state.
 type Encoder struct {
 	Name     string
 	getStep  GetStep
 	syncer   Syncer
 	enc      IO    // I/O from encoder hardware
 	Invert   bool  // Invert input signal
-	Measured int   // Measured steps per revolution
+	measured int   // Measured steps per revolution, guarded by mu
+	Reverse  bool  // True if the last movement was counter-clockwise
 	size     int64 // Minimum span of sensor mark
-	lastEdge int64 // Last location of encoder mark
+	marks    int   // Number of marks in a revolution
+	index    int64 // Minimum span of index mark, 0 if not distinguishable
+	lastEdge int64 // Last location of encoder index mark, guarded by mu
+	seeded   bool  // True if lastEdge has been set from a saved state, guarded by mu
+	mu       sync.Mutex
+	interval []int      // History of raw measurements, guarded by mu
+	errs     chan error // Failure of the encoder input
+	edges    int64      // Count of input edges, accessed atomically
 }
 
 // NewEncoder creates a new Encoder structure.
-func NewEncoder(name string, stepper GetStep, syncer Syncer, io IO, size int) *Encoder {
+// The encoder has marks marks of at least size steps wide, and if index is non-zero,
+// the index mark is at least index steps wide.
+func NewEncoder(name string, stepper GetStep, syncer Syncer, io IO, size, marks, index int) *Encoder {
 	e := new(Encoder)
 	e.Name = name
 	e.getStep = stepper
 	e.syncer = syncer
 	e.enc = io
 	e.size = int64(size)
+	e.marks = marks
+	if e.marks < 1 {
+		e.marks = 1
+	}
+	e.index = int64(index)
+	e.lastEdge = int64(-1)
+	e.errs = make(chan error, 1)
 	go e.driver()
 	return e
 }
 
-// Location returns the current location as a relative position from the encoder mark
+// Location returns the current location as a relative position from the encoder index mark
 func (e *Encoder) Location() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	return int(e.getStep.GetStep() - e.lastEdge)
 }
 
+// Measured returns the measured steps per revolution.
+func (e *Encoder) Measured() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.measured
+}
+
+// Errors returns a channel that reports the failure of the encoder.
+func (e *Encoder) Errors() <-chan error {
+	return e.errs
+}
+
+// Intervals returns the history of raw measurements of the steps per revolution.
+func (e *Encoder) Intervals() []int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]int(nil), e.interval...)
+}
+
+// Edges returns the number of input edges seen.
+func (e *Encoder) Edges() int64 {
+	return atomic.LoadInt64(&e.edges)
+}
+
+// ClearIntervals clears the history of measurements.
+func (e *Encoder) ClearIntervals() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.interval = nil
+}
+
+// Seed initialises the encoder from a saved state. Must be called
+// before the motor is moved.
+func (e *Encoder) Seed(measured int, index int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.measured = measured
+	e.lastEdge = index
+	e.seeded = measured != 0
+}
+
 // driver is the main goroutine for servicing the encoder.
 // Edge triggered input values are read, and encoder marks are searched for.
+// If the input fails, the failure is reported and the driver exits.
 // An encoder mark is a 0->1->0 transition of at least a minimum size, usually
 // correlating to a physical sensor such as an interrupting shaft photo-sensor.
-// The 1->0 transition is considered the reference point for measuring the
-// number of steps in a revolution.
+// The trailing edge of the mark (when moving clockwise) is considered
+// the reference point for measuring the number of steps in a revolution.
+// When moving clockwise, this is the 1->0 transition, but when moving
+// counter-clockwise it is the 0->1 transition, which is only known to be
+// part of the mark once the following 1->0 transition has been seen.
+// The revolution is only measured between marks seen in the same direction, and
+// is measured from the same mark one revolution earlier.
 func (e *Encoder) driver() {
 	last := int64(0)
-	e.lastEdge = int64(-1)
 	lastMeasured := 0
+	lastReverse := false
+	num := -1        // Number of the last mark, or -1 if not known
+	var hist []int64 // Mark locations in the current direction
+	rise := int64(0)
+	riseSeen := false
+	riseReverse := false
 	var mavg []int
 	avgTotal := 0
 	avgIndex := 0
+	errCount := 0
 	for {
 		// Retrieve the sensor value when it changes.
 		s, err := e.enc.Get()
 		if err != nil {
-			log.Fatalf("%s: Encoder input: %v", e.Name, err)
+			// Allow for transient errors, but give up if the input has failed.
+			if errCount++; errCount >= maxInputErrors {
+				log.Printf("%s: Encoder input failed, no longer tracking hand: %v", e.Name, err)
+				e.errs <- fmt.Errorf("%s: %w: %v", e.Name, ErrEncoder, err)
+				return
+			}
+			log.Printf("%s: Encoder input: %v", e.Name, err)
+			time.Sleep(inputRetry)
+			continue
 		}
+		errCount = 0
+		atomic.AddInt64(&e.edges, 1)
 		if e.Invert {
 			s = s ^ 1
 		}
-		// Retrieve the current absolute location.
+		// Retrieve the current absolute location, and
+		// determine the direction of movement.
 		loc := e.getStep.GetStep()
-		// Check for debounce, and discard if noisy.
+		turned := false
+		if loc != last {
+			turned = (loc < last) != e.Reverse
+			e.Reverse = loc < last
+		}
+		// Check for debounce, and discard if noisy. If the direction has
+		// changed, this is the same edge being crossed in the other direction.
 		d := diff(loc, last)
 		last = loc
-		if debounce != 0 && d < debounce {
+		if debounce != 0 && d < debounce && !turned {
 			continue
 		}
+		if s == 1 {
+			// Start of a possible mark.
+			rise = loc
+			riseSeen = true
+			riseReverse = e.Reverse
+			continue
+		}
+		// A 1->0 transition without a preceding 0->1 transition
+		// e.g the sensor started within the mark.
+		if !riseSeen {
+			continue
+		}
+		riseSeen = false
 		// Transitioned from 1 to 0, and the signal is large
 		// enough to be considered as the real encoder mark.
-		if s == 0 && d >= e.size {
-			if e.lastEdge > 0 {
-				// If the previous sensor edge has been seen,
-				// calculate the difference between the current
-				// mark and the previous mark.
-				// This is the measured number of steps in a revolution.
-				newM := int(diff(e.lastEdge, loc))
-				if avgTotal == 0 {
-					// If first time, init moving average.
-					for i := 0; i < mAvgCount; i++ {
-						mavg = append(mavg, newM)
-					}
-					avgTotal = newM * mAvgCount
+		// If the direction changed within the mark, it is discarded.
+		if diff(loc, rise) < e.size || riseReverse != e.Reverse {
+			continue
+		}
+		ref := loc
+		if e.Reverse {
+			ref = rise
+		}
+		e.mu.Lock()
+		measured, lastEdge, seeded := e.measured, e.lastEdge, e.seeded
+		e.mu.Unlock()
+		// Identify which mark this is.
+		switch {
+		case e.marks == 1 || (e.index != 0 && diff(loc, rise) >= e.index):
+			num = 0
+		case num >= 0 && lastReverse == e.Reverse:
+			// The next mark in the direction of movement.
+			if e.Reverse {
+				num = (num + e.marks - 1) % e.marks
+			} else {
+				num = (num + 1) % e.marks
+			}
+		case num >= 0:
+			// The direction has changed, so this is the mark last seen.
+		case seeded:
+			// Identify the mark from the saved location of the index mark.
+			d := (ref - lastEdge) % int64(measured)
+			if d < 0 {
+				d += int64(measured)
+			}
+			num = int((d*int64(e.marks)+int64(measured/2))/int64(measured)) % e.marks
+		default:
+			// Waiting for the index mark.
+			continue
+		}
+		if lastReverse != e.Reverse {
+			hist = hist[:0]
+		}
+		hist = append(hist, ref)
+		if len(hist) > e.marks {
+			// If the same mark has been seen one revolution ago in the same direction,
+			// calculate the difference between the current
+			// mark and the previous mark.
+			// This is the measured number of steps in a revolution.
+			newM := int(diff(hist[0], ref))
+			hist = hist[1:]
+			e.mu.Lock()
+			e.interval = addInterval(e.interval, newM)
+			e.mu.Unlock()
+			if avgTotal == 0 {
+				// If first time, init moving average.
+				for i := 0; i < mAvgCount; i++ {
+					mavg = append(mavg, newM)
 				}
-				// Recalculate moving average.
-				avgTotal = avgTotal - mavg[avgIndex] + newM
-				avgIndex = (avgIndex + 1) % mAvgCount
-				newM = avgTotal / mAvgCount
-				e.Measured = newM
-				e.syncer.Mark(newM, loc)
-				log.Printf("%s: Mark at %d (%d)", e.Name, e.Measured, e.Measured-lastMeasured)
-				lastMeasured = newM
+				avgTotal = newM * mAvgCount
 			}
-			e.lastEdge = loc
+			// Recalculate moving average.
+			avgTotal = avgTotal - mavg[avgIndex] + newM
+			avgIndex = (avgIndex + 1) % mAvgCount
+			measured = avgTotal / mAvgCount
+			e.mu.Lock()
+			e.measured = measured
+			e.mu.Unlock()
+			log.Printf("%s: Mark %d at %d (%d)", e.Name, num, measured, measured-lastMeasured)
+			lastMeasured = measured
+		} else if lastReverse != e.Reverse {
+			log.Printf("%s: Mark %d at %d (direction changed, not measured)", e.Name, num, ref)
+		}
+		pos := 0
+		if measured != 0 {
+			pos = num * measured / e.marks
+			e.syncer.Mark(measured, ref, pos)
 		}
+		e.mu.Lock()
+		e.lastEdge = ref - int64(pos)
+		e.mu.Unlock()
+		lastReverse = e.Reverse
+	}
+}
+
+// addInterval adds a measurement to the interval history.
+func addInterval(h []int, m int) []int {
+	h = append(h, m)
+	if len(h) > histSize {
+		h = h[1:]
 	}
+	return h
 }
 
 // Get difference between 2 absolute locations.
@@ -0,0 +1,189 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hand
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeEncoder simulates the encoder input and the stepper location.
+// The input is in step with the encoder driver, so that each edge
+// is processed before the stepper moves on.
+type fakeEncoder struct {
+	t     *testing.T
+	step  int64
+	rev   int64      // Steps in a revolution
+	spans [][2]int64 // Marks, as the range of positions that set the input
+	val   int
+	in    chan int
+	wait  chan struct{} // Signalled when the driver is waiting for input
+}
+
+func newFakeEncoder(t *testing.T, rev int64, spans ...[2]int64) *fakeEncoder {
+	return &fakeEncoder{t: t, rev: rev, spans: spans, in: make(chan int), wait: make(chan struct{})}
+}
+
+func (f *fakeEncoder) GetStep() int64 {
+	return f.step
+}
+
+func (f *fakeEncoder) Get() (int, error) {
+	f.wait <- struct{}{}
+	return <-f.in, nil
+}
+
+// ready waits until the driver is waiting for input.
+func (f *fakeEncoder) ready() {
+	select {
+	case <-f.wait:
+	case <-time.After(time.Second):
+		f.t.Fatalf("encoder driver not reading input")
+	}
+}
+
+// move steps the stepper, sending the input to the driver when it changes.
+func (f *fakeEncoder) move(n int) {
+	inc := int64(1)
+	if n < 0 {
+		inc = -1
+		n = -n
+	}
+	for i := 0; i < n; i++ {
+		f.step += inc
+		p := ((f.step % f.rev) + f.rev) % f.rev
+		v := 0
+		for _, s := range f.spans {
+			if p >= s[0] && p < s[1] {
+				v = 1
+			}
+		}
+		if v != f.val {
+			f.val = v
+			f.in <- v
+			f.ready()
+		}
+	}
+}
+
+// marks records the calls to Mark.
+type marks struct {
+	measured []int
+	loc      []int64
+	pos      []int
+}
+
+func (m *marks) Mark(measured int, loc int64, pos int) {
+	m.measured = append(m.measured, measured)
+	m.loc = append(m.loc, loc)
+	m.pos = append(m.pos, pos)
+}
+
+func (m *marks) reset() {
+	*m = marks{}
+}
+
+func (m *marks) check(t *testing.T, msg string, loc []int64, pos []int) {
+	t.Helper()
+	if !reflect.DeepEqual(m.loc, loc) || !reflect.DeepEqual(m.pos, pos) {
+		t.Errorf("%s: marks at %v (pos %v), expected %v (pos %v)", msg, m.loc, m.pos, loc, pos)
+	}
+	for _, v := range m.measured {
+		if v != 1000 {
+			t.Errorf("%s: measured %d, expected 1000", msg, v)
+		}
+	}
+}
+
+func newTestEncoder(f *fakeEncoder, m *marks, size, count, index int) *Encoder {
+	e := NewEncoder("test", f, m, f, size, count, index)
+	f.ready()
+	return e
+}
+
+func TestEncoderForwardReverse(t *testing.T) {
+	f := newFakeEncoder(t, 1000, [2]int64{300, 400})
+	m := &marks{}
+	e := newTestEncoder(f, m, 50, 1, 0)
+	// Clockwise, the trailing edge of the mark is the reference.
+	// The first mark is not reported as the revolution is not yet measured.
+	f.move(3500)
+	m.check(t, "forward", []int64{1400, 2400, 3400}, []int{0, 0, 0})
+	if e.Reverse {
+		t.Errorf("forward: direction is reverse")
+	}
+	// Counter-clockwise, the reference is the same edge, seen
+	// as the leading edge of the mark.
+	m.reset()
+	f.move(-2500)
+	m.check(t, "reverse", []int64{3399, 2399, 1399}, []int{0, 0, 0})
+	if !e.Reverse {
+		t.Errorf("reverse: direction is forward")
+	}
+	if e.Measured() != 1000 {
+		t.Errorf("measured %d, expected 1000", e.Measured())
+	}
+}
+
+func TestEncoderReverseInMark(t *testing.T) {
+	f := newFakeEncoder(t, 1000, [2]int64{300, 400})
+	m := &marks{}
+	newTestEncoder(f, m, 50, 1, 0)
+	// Stop within the mark, and back out of it.
+	f.move(1350)
+	f.move(-100)
+	f.move(1200)
+	m.check(t, "reverse in mark", []int64{1400, 2400}, []int{0, 0})
+}
+
+func TestEncoderDebounce(t *testing.T) {
+	// The leading edge of the mark bounces.
+	f := newFakeEncoder(t, 1000, [2]int64{300, 302}, [2]int64{304, 400})
+	m := &marks{}
+	newTestEncoder(f, m, 98, 1, 0)
+	f.move(2500)
+	m.check(t, "debounce", []int64{1400, 2400}, []int{0, 0})
+}
+
+func TestEncoderMultiMark(t *testing.T) {
+	// 4 marks, with the wide index mark ending at 300.
+	f := newFakeEncoder(t, 1000, [2]int64{0, 50}, [2]int64{100, 300}, [2]int64{500, 550}, [2]int64{750, 800})
+	m := &marks{}
+	newTestEncoder(f, m, 30, 4, 150)
+	// Marks before the index mark are ignored.
+	f.move(2600)
+	m.check(t, "multi forward", []int64{1300, 1550, 1800, 2050, 2300, 2550}, []int{0, 250, 500, 750, 0, 250})
+	m.reset()
+	f.move(-1300)
+	m.check(t, "multi reverse", []int64{2549, 2299, 2049, 1799, 1549}, []int{250, 0, 750, 500, 250})
+}
+
+func TestEncoderMultiMarkNoIndex(t *testing.T) {
+	// 4 marks of the same width, which cannot be identified without a saved state.
+	spans := [][2]int64{{200, 250}, {450, 500}, {700, 750}, {950, 1000}}
+	f := newFakeEncoder(t, 1000, spans...)
+	m := &marks{}
+	newTestEncoder(f, m, 30, 4, 0)
+	f.move(2600)
+	m.check(t, "not seeded", nil, nil)
+	// The saved location of the index mark identifies the marks.
+	f = newFakeEncoder(t, 1000, spans...)
+	m.reset()
+	e := newTestEncoder(f, m, 30, 4, 0)
+	e.Seed(1000, 500)
+	f.move(1300)
+	m.check(t, "seeded", []int64{250, 500, 750, 1000, 1250}, []int{750, 0, 250, 500, 750})
+}
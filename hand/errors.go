@@ -0,0 +1,48 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Errors reported by the clock hands.
+
+package hand
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCalibrate is returned when a hand cannot be calibrated because
+// the encoder mark was not seen.
+var ErrCalibrate = errors.New("unable to calibrate")
+
+// ErrEncoder is reported when the input from an encoder has failed.
+var ErrEncoder = errors.New("encoder failed")
+
+// errClosed is returned when moving a hand that has been closed.
+var errClosed = errors.New("hand closed")
+
+// errRecalibrate is returned from Hand.Run when a recalibration has been requested.
+var errRecalibrate = errors.New("recalibration requested")
+
+// Number of consecutive input errors before an encoder is considered to have failed.
+const maxInputErrors = 10
+
+// Delay before retrying a failed input.
+const inputRetry = 100 * time.Millisecond
+
+// ErrorReporter is implemented by sensors that report failures
+// asynchronously. A sensor that has failed no longer provides feedback,
+// but the hand may continue to run without it.
+type ErrorReporter interface {
+	Errors() <-chan error
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Hand events, and streaming of the events to web clients.
+
+package hand
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Types of hand events.
+const (
+	EventPosition    = "position"     // Hand has moved
+	EventMark        = "mark"         // Encoder mark seen, Steps is the position error
+	EventCorrection  = "correction"   // Location corrected between marks, Steps is the position error
+	EventSkip        = "skip"         // Small backwards move skipped
+	EventFastForward = "fast_forward" // Unplanned fast forward, Steps is the size of the move
+	EventReturn      = "return"       // Retrograde hand returned to the start of its arc
+	EventPause       = "pause"        // Hand paused or parked
+	EventResume      = "resume"       // Hand resumed
+)
+
+// Size of the event buffer for each stream.
+const eventBuffer = 32
+
+// Interval between keepalives sent on an idle event stream.
+const keepalive = 30 * time.Second
+
+// subscribers is the set of channels that hand events are sent to.
+type subscribers map[chan<- Event]struct{}
+
+// Event is sent to subscribers when the state of a hand changes.
+type Event struct {
+	Type  string     `json:"type"`
+	Time  time.Time  `json:"time"`
+	Steps int        `json:"steps,omitempty"`
+	Hand  HandStatus `json:"hand"` // Status of the hand after the event
+}
+
+// Subscribe sends the events of the hand to the channel until the
+// returned function is called. Events are dropped if the channel is full,
+// so that a slow subscriber does not hold up the hand.
+func (h *Hand) Subscribe(ch chan<- Event) func() {
+	h.subMu.Lock()
+	defer h.subMu.Unlock()
+	if h.subs == nil {
+		h.subs = make(subscribers)
+	}
+	h.subs[ch] = struct{}{}
+	return func() {
+		h.subMu.Lock()
+		delete(h.subs, ch)
+		h.subMu.Unlock()
+	}
+}
+
+// publish sends an event to the subscribers of the hand.
+// Must not be called with the hand lock held.
+func (h *Hand) publish(kind string, steps int) {
+	h.subMu.Lock()
+	defer h.subMu.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	ev := Event{Type: kind, Time: h.ts.Now(), Steps: steps, Hand: h.Status()}
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// events streams the hand events as server-sent events. The stream
+// starts with the current position of each hand, and may be limited
+// to the hands of a single dial.
+func events(clock []*Hand) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fl, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		var hands []*Hand
+		for _, h := range clock {
+			if d, ok := r.URL.Query()["dial"]; !ok || d[0] == h.Dial {
+				hands = append(hands, h)
+			}
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		ch := make(chan Event, eventBuffer)
+		for _, h := range hands {
+			defer h.Subscribe(ch)()
+		}
+		for _, h := range hands {
+			if !sendEvent(w, Event{Type: EventPosition, Time: h.ts.Now(), Hand: h.Status()}) {
+				return
+			}
+		}
+		fl.Flush()
+		ka := time.NewTicker(keepalive)
+		defer ka.Stop()
+		for {
+			select {
+			case ev := <-ch:
+				if !sendEvent(w, ev) {
+					return
+				}
+			case <-ka.C:
+				if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+			fl.Flush()
+		}
+	}
+}
+
+// sendEvent writes an event to the stream, returning false if the client has gone.
+func sendEvent(w http.ResponseWriter, ev Event) bool {
+	b, err := json.Marshal(&ev)
+	if err != nil {
+		return false
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+	return err == nil
+}
@@ -0,0 +1,296 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Built-in clock face, rendered as SVG or as an image.
+
+package hand
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/fogleman/gg"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// Size in pixels of the rendered face, and the limits on the requested size.
+const (
+	faceSize    = 600
+	faceSizeMin = 64
+	faceSizeMax = 4096
+)
+
+// Size of the built-in face used when there is no clock face image.
+const faceImageSize = 1200
+
+// Font of the numerals, parsed once when first used.
+var (
+	fontOnce    sync.Once
+	numeralFont *truetype.Font
+	fontErr     error
+)
+
+// loadFont returns the font of the numerals.
+func loadFont() (*truetype.Font, error) {
+	fontOnce.Do(func() {
+		numeralFont, fontErr = truetype.Parse(goregular.TTF)
+	})
+	return numeralFont, fontErr
+}
+
+// Face is the clock face image used by the status server, and the
+// centre and radius of the dial within the image, in pixels.
+// A zero centre or radius is derived from the size of the image.
+type Face struct {
+	Image  string // Image file, empty to use the built-in face
+	X, Y   float64
+	Radius float64
+}
+
+// geometry is the centre and radius of the dial within a clock face image.
+type geometry struct {
+	x, y, radius float64
+}
+
+// faceGeometry returns the geometry of a rendered face of the given size.
+func faceGeometry(size int) geometry {
+	s := float64(size) / 2
+	return geometry{s, s, s * 0.95}
+}
+
+// painter draws the elements of a clock face.
+// A nil fill colour leaves the circle unfilled.
+type painter interface {
+	circle(x, y, r, width float64, stroke, fill color.Color)
+	line(x1, y1, x2, y2, width float64, c color.Color)
+	text(x, y, size float64, s string, c color.Color)
+}
+
+// drawFace draws the dial, with tick marks for each minute
+// and numerals for each hour.
+func drawFace(p painter, g geometry) {
+	r := g.radius
+	p.circle(g.x, g.y, r, r*0.02, color.Black, color.White)
+	for i := 0; i < 60; i++ {
+		a := float64(i) * math.Pi / 30
+		inner, width := r*0.95, r*0.006
+		if i%5 == 0 {
+			inner, width = r*0.9, r*0.02
+		}
+		x1, y1 := g.point(a, inner)
+		x2, y2 := g.point(a, r*0.98)
+		p.line(x1, y1, x2, y2, width, color.Black)
+	}
+	for i := 1; i <= 12; i++ {
+		x, y := g.point(float64(i)*math.Pi/6, r*0.77)
+		p.text(x, y, r*0.15, strconv.Itoa(i), color.Black)
+	}
+}
+
+// drawHands draws the hands of the dial in their current positions.
+func drawHands(p painter, g geometry, clock []*Hand, dial string) {
+	for _, h := range clock {
+		if h.Dial != dial {
+			continue
+		}
+		hd := handStyle(h)
+		pos, r, _ := h.Get()
+		x, y := g.point(float64(pos)*2*math.Pi/float64(r), hd.length*g.radius)
+		p.line(g.x, g.y, x, y, hd.width*g.radius, hd.colour())
+	}
+}
+
+// renderFace draws the complete face, with the hands and the hub that covers them.
+func renderFace(p painter, g geometry, clock []*Hand, dial string) {
+	drawFace(p, g)
+	drawHands(p, g, clock, dial)
+	p.circle(g.x, g.y, g.radius*0.03, 0, color.Black, color.Black)
+}
+
+// point returns the location at the angle (in radians clockwise
+// from the top of the dial) and distance from the centre of the dial.
+func (g geometry) point(a, l float64) (float64, float64) {
+	return g.x + l*math.Sin(a), g.y - l*math.Cos(a)
+}
+
+// svgPainter writes the face as SVG elements.
+type svgPainter struct {
+	w io.Writer
+}
+
+func (p *svgPainter) circle(x, y, r, width float64, stroke, fill color.Color) {
+	f := "none"
+	if fill != nil {
+		f = svgColour(fill)
+	}
+	fmt.Fprintf(p.w, "<circle cx=\"%.1f\" cy=\"%.1f\" r=\"%.1f\" stroke=\"%s\" stroke-width=\"%.1f\" fill=\"%s\"/>\n", x, y, r, svgColour(stroke), width, f)
+}
+
+func (p *svgPainter) line(x1, y1, x2, y2, width float64, c color.Color) {
+	fmt.Fprintf(p.w, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"%s\" stroke-width=\"%.1f\" stroke-linecap=\"round\"/>\n", x1, y1, x2, y2, svgColour(c), width)
+}
+
+func (p *svgPainter) text(x, y, size float64, s string, c color.Color) {
+	fmt.Fprintf(p.w, "<text x=\"%.1f\" y=\"%.1f\" font-size=\"%.1f\" font-family=\"Go, sans-serif\" text-anchor=\"middle\" dominant-baseline=\"central\" fill=\"%s\">%s</text>\n", x, y, size, svgColour(c), html.EscapeString(s))
+}
+
+// svgColour returns the colour in SVG notation.
+func svgColour(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+// imagePainter draws the face onto an image.
+// The font face is kept, as the numerals are all the same size.
+type imagePainter struct {
+	c    *gg.Context
+	font *truetype.Font
+	face font.Face // Font face of the last text drawn
+	size float64   // Size of the font face
+}
+
+func (p *imagePainter) circle(x, y, r, width float64, stroke, fill color.Color) {
+	p.c.DrawCircle(x, y, r)
+	if fill != nil {
+		p.c.SetColor(fill)
+		p.c.FillPreserve()
+	}
+	p.c.SetColor(stroke)
+	p.c.SetLineWidth(width)
+	p.c.Stroke()
+}
+
+func (p *imagePainter) line(x1, y1, x2, y2, width float64, c color.Color) {
+	p.c.SetColor(c)
+	p.c.SetLineWidth(width)
+	p.c.DrawLine(x1, y1, x2, y2)
+	p.c.Stroke()
+}
+
+func (p *imagePainter) text(x, y, size float64, s string, c color.Color) {
+	if p.face == nil || p.size != size {
+		p.face = truetype.NewFace(p.font, &truetype.Options{Size: size})
+		p.size = size
+		p.c.SetFontFace(p.face)
+	}
+	p.c.SetColor(c)
+	p.c.DrawStringAnchored(s, x, y, 0.5, 0.5)
+}
+
+// faceImage renders the face as an image, with the hands of the dial
+// drawn if clock is not nil.
+func faceImage(clock []*Hand, dial string, size int) (image.Image, error) {
+	f, err := loadFont()
+	if err != nil {
+		return nil, err
+	}
+	c := gg.NewContext(size, size)
+	c.SetColor(color.White)
+	c.Clear()
+	p := &imagePainter{c: c, font: f}
+	g := faceGeometry(size)
+	if clock == nil {
+		drawFace(p, g)
+	} else {
+		renderFace(p, g, clock, dial)
+	}
+	return c.Image(), nil
+}
+
+// parseColour parses a colour of the form #rrggbb.
+func parseColour(s string) (color.Color, error) {
+	var c color.RGBA
+	if len(s) != 7 || s[0] != '#' {
+		return nil, fmt.Errorf("%s: must be #rrggbb", s)
+	}
+	v, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%s: must be #rrggbb", s)
+	}
+	c.R, c.G, c.B, c.A = uint8(v>>16), uint8(v>>8), uint8(v), 255
+	return c, nil
+}
+
+// parsePercent parses a percentage of up to max, and returns it as a fraction.
+func parsePercent(s string, max float64) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v <= 0 || v > max {
+		return 0, fmt.Errorf("must be greater than 0 and at most %g", max)
+	}
+	return v / 100, nil
+}
+
+// requestSize returns the face size selected by the size URL parameter.
+func requestSize(w http.ResponseWriter, r *http.Request) (int, bool) {
+	s := r.FormValue("size")
+	if s == "" {
+		return faceSize, true
+	}
+	size, err := strconv.Atoi(s)
+	if err != nil || size < faceSizeMin || size > faceSizeMax {
+		http.Error(w, fmt.Sprintf("size must be between %d and %d", faceSizeMin, faceSizeMax), http.StatusBadRequest)
+		return 0, false
+	}
+	return size, true
+}
+
+// Display the rendered clock face as SVG.
+// The dial and size URL parameters select the dial and the size of the face.
+func svgHandler(clock []*Hand) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		size, ok := requestSize(w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", size, size, size, size)
+		renderFace(&svgPainter{w}, faceGeometry(size), clock, r.FormValue("dial"))
+		fmt.Fprintf(w, "</svg>\n")
+	}
+}
+
+// Display the rendered clock face as PNG.
+// The dial and size URL parameters select the dial and the size of the face.
+func pngHandler(clock []*Hand) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		size, ok := requestSize(w, r)
+		if !ok {
+			return
+		}
+		img, err := faceImage(clock, r.FormValue("dial"), size)
+		if err != nil {
+			log.Printf("Error rendering face: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		if err := png.Encode(w, img); err != nil {
+			log.Printf("Error writing image: %v\n", err)
+		}
+	}
+}
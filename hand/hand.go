@@ -17,22 +17,28 @@
 package hand
 
 import (
+	"context"
+	"image/color"
 	"log"
+	"math"
 	"sync"
 	"time"
 )
 
 // MoveHand is the interface to move the hand by a selected number of steps.
+// A move may be interrupted by cancelling the context, in which case
+// the context error is returned.
 type MoveHand interface {
-	Move(int)
+	Move(context.Context, int) error
 	GetLocation() int64 // Get current location
 }
 
 // Hand represents a clock hand. A single revolution of the hand
-// is represented by a number of ticks, determined by the update duration
+// is represented by a number of ticks, determined by the Targeter
 // for the hand e.g a minute hand takes 60 minutes for a revolution, and is
-// updated every 5 seconds (to make the motion smooth), so this hand has 720 ticks (60 * 60 / 5).
-// Ticking the clock involves moving the hand by one tick each update period.
+// updated every 5 seconds (to make the motion smooth), so this hand has 720 ticks (60 * 60 / 5),
+// whereas a date hand has 31 ticks, one for each day.
+// Ticking the clock involves checking the target tick each update period, and moving the hand to it.
 // Ticks are not steps; a single tick is usually a number of steps.
 //
 // The number of steps in a single revolution is held in actual,
@@ -48,7 +54,14 @@ type MoveHand interface {
 // The current step number is used to determine how many steps the hand
 // needs to move to get to 1133.
 //
-// Moving is only performed in a clockwise direction.
+// The time displayed is the wall clock time in the time zone of the hand
+// (except for astronomical hands such as moon phase, which use the absolute time).
+// When daylight saving starts the hand is fast-forwarded, and when it ends
+// the hand is held until the wall clock catches up.
+//
+// Moving is only performed in a clockwise direction, except for retrograde
+// hands, which cover a limited arc of the dial and then move counter-clockwise
+// back to the start of the arc. The arc covers a full period of the hand.
 // An offset may be provided that correlates the encoder mark reference point
 // and the actual physical location of the hand - when the hand is at the
 // encoder reference point, the offset represents the relative offset of the
@@ -56,39 +69,214 @@ type MoveHand interface {
 // the location of the hand as steps away from the top of the clock face.
 type Hand struct {
 	Name        string        // Name of this hand
-	Ticking     bool          // True if the clock has completed initialisation and is ticking.
+	Dial        string        // Name of the dial this hand is part of
+	Ticking     bool          // True if the clock has completed initialisation and is ticking, guarded by mu
 	base        int64         // position of last encoder mark
 	mover       MoveHand      // Mover to move the hand
+	ts          TimeSource    // Source of the current time
+	zone        *zone         // Time zone of the hand
+	planned     string        // Reason for a planned fast forward, if any
+	paused      bool          // Hand is paused
+	parking     bool          // Hand is to be moved to the park position
+	recalibrate bool          // Hand is to be recalibrated
+	park        float64       // Park position in degrees clockwise from the top of the dial
+	wake        chan struct{} // Wakes the Run loop when the hand is paused or resumed
+	stop        chan struct{} // Closed to stop the Run loop
+	stopped     bool          // Hand has been stopped, guarded by mu
+	targeter    Targeter      // Determines the target position
 	update      time.Duration // Update interval
-	ticks       int           // Number of segments in clock face
 	reference   int           // Reference steps per clock revolution
 	actual      int           // Measured steps per revolution
-	divisor     int           // Used to calculate ticks
 	skipMove    int           // Minimum amount required to fast forward
+	tickSteps   int           // Steps in a single tick of the targeter, guarded by mu
+	lastTick    int64         // Last target tick, -1 if none, guarded by mu
 	offset      int           // Offset of hand at encoder mark
+	arc         float64       // Arc in degrees covered by a retrograde hand
+	colour      color.Color   // Colour the hand is drawn in, nil for the default
+	length      float64       // Length the hand is drawn as a fraction of the dial radius, 0 for the default
+	width       float64       // Width the hand is drawn as a fraction of the dial radius, 0 for the default
 	mu          sync.Mutex    // Guards base and actual
+	subMu       sync.Mutex    // Guards subs
+	subs        subscribers   // Subscribers to the hand events
 	Marks       int           // Number of times encoder mark hit
+	MarkError   int           // Position error in steps when the last mark was hit
+	Corrections int           // Number of location corrections between marks
+	Confidence  float64       // Confidence in the calibration measurement
+	CalTime     time.Duration // Duration of the last calibration
 	Skipped     int           // Number of skipped moves
 	FastForward int           // Number of fast forward movements
 	Adjusted    int           // Number of hand adjustments
+	Returned    int           // Number of retrograde returns
 }
 
 // NewHand creates and initialises a Hand structure.
-func NewHand(name string, unit time.Duration, mover MoveHand, update time.Duration, steps, offset int) *Hand {
+// The TimeSource provides the time that the hand displays, and
+// the Targeter converts that time to a position of the hand.
+func NewHand(name string, ts TimeSource, tg Targeter, mover MoveHand, update time.Duration, steps, offset int) *Hand {
 	h := new(Hand)
 	h.Name = name
+	h.ts = ts
+	h.targeter = tg
+	h.zone = newZone(time.Local, tg.Period())
 	h.mover = mover
 	h.update = update
-	h.ticks = int(unit / update)
-	h.divisor = int(update.Milliseconds())
 	h.reference = steps
 	h.actual = steps // Initial reference value
 	h.offset = offset
 	h.skipMove = steps / 100
-	log.Printf("%s: ticks %d, reference steps %d, divisor %d, offset %d\n", h.Name, h.ticks, h.reference, h.divisor, h.offset)
+	h.wake = make(chan struct{}, 1)
+	h.stop = make(chan struct{})
+	h.lastTick = -1
+	log.Printf("%s: type %s, reference steps %d, update %s, offset %d\n", h.Name, tg.Kind(), h.reference, h.update, h.offset)
 	return h
 }
 
+// SetLocation sets the time zone that the hand displays, and
+// a shift that is added to the time displayed.
+// By default, the local time zone is used with no shift.
+func (h *Hand) SetLocation(loc *time.Location, shift time.Duration) {
+	h.zone = newZone(loc, h.zone.period)
+	h.zone.shift = shift
+}
+
+// SetArc makes the hand a retrograde hand that covers the arc (in degrees) selected.
+func (h *Hand) SetArc(arc float64) {
+	h.arc = arc
+}
+
+// SetPark sets the position that the hand is parked at, in
+// degrees clockwise from the top of the dial.
+func (h *Hand) SetPark(deg float64) {
+	h.park = deg
+}
+
+// SetStyle sets how the hand is drawn on the clock face, overriding the
+// default style for the hand. The length and width are fractions of the
+// radius of the dial, and a nil colour or zero length or width keeps the default.
+func (h *Hand) SetStyle(colour color.Color, length, width float64) {
+	h.colour = colour
+	h.length = length
+	h.width = width
+}
+
+// Pause stops the hand moving until it is resumed.
+func (h *Hand) Pause() {
+	h.mu.Lock()
+	h.paused = true
+	h.mu.Unlock()
+	log.Printf("%s: Paused", h.Name)
+	h.publish(EventPause, 0)
+}
+
+// Park pauses the hand and moves it to the park position.
+func (h *Hand) Park() {
+	h.mu.Lock()
+	h.paused = true
+	h.parking = true
+	h.mu.Unlock()
+	log.Printf("%s: Parking", h.Name)
+	h.publish(EventPause, 0)
+	h.signal()
+}
+
+// Resume restarts a paused or parked hand, which
+// catches up to the current time.
+func (h *Hand) Resume() {
+	h.mu.Lock()
+	if h.paused {
+		h.paused = false
+		h.parking = false
+		h.planned = "resume"
+	}
+	h.mu.Unlock()
+	log.Printf("%s: Resumed", h.Name)
+	h.publish(EventResume, 0)
+	h.signal()
+}
+
+// Recalibrate requests that the hand is recalibrated. The Run loop
+// returns errRecalibrate so that the calibration can be rerun.
+func (h *Hand) Recalibrate() {
+	h.mu.Lock()
+	h.recalibrate = true
+	h.mu.Unlock()
+	log.Printf("%s: Recalibration requested", h.Name)
+	h.signal()
+}
+
+// Stop stops the Run loop once any tick move in progress has completed.
+// A calibration or verification of the hand in progress is abandoned.
+// A stopped hand cannot be restarted.
+func (h *Hand) Stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.stopped {
+		h.stopped = true
+		close(h.stop)
+		log.Printf("%s: Stopping", h.Name)
+	}
+}
+
+// stopContext returns a context that is also cancelled when the hand is stopped,
+// so that moves other than ticks (e.g calibration) are abandoned.
+func (h *Hand) stopContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-h.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// isStopped returns true if the hand has been stopped.
+func (h *Hand) isStopped() bool {
+	select {
+	case <-h.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Paused returns true if the hand is paused or parked.
+func (h *Hand) Paused() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.paused
+}
+
+// setTicking records whether the hand is ticking.
+func (h *Hand) setTicking(t bool) {
+	h.mu.Lock()
+	h.Ticking = t
+	h.mu.Unlock()
+}
+
+// signal wakes the Run loop so that a change of state is acted upon.
+func (h *Hand) signal() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Kind returns the kind of hand e.g clock, date.
+func (h *Hand) Kind() string {
+	return h.targeter.Kind()
+}
+
+// Transition returns the time of the next daylight saving transition
+// and the change of offset, or a zero time if there is none in the next year.
+func (h *Hand) Transition() (time.Time, time.Duration) {
+	if _, ok := h.targeter.(absolute); ok {
+		return time.Time{}, 0
+	}
+	return h.zone.upcoming(h.ts.Now())
+}
+
 // Get returns the current relative position,
 // the number of steps in a revolution, and
 // the current offset.
@@ -117,59 +305,189 @@ func (h *Hand) Adjust(adj int) int {
 
 // Mark updates the steps per revolution and sets the current location to a preset value.
 // Usually called from a sensor encoder at the point when an encoder mark is detected, indicating
-// a known physical location of the hand.
-func (h *Hand) Mark(adj int, loc int64) {
-	h.Marks++
+// a known physical location of the hand. The mark is pos steps from the encoder index mark.
+// The difference between the expected and actual location is recorded as the position error.
+func (h *Hand) Mark(adj int, loc int64, pos int) {
 	h.mu.Lock()
-	defer h.mu.Unlock()
+	h.Marks++
 	h.actual = adj
+	// Record how far the hand was from the expected location.
+	e := h.locationError(loc, pos)
+	h.MarkError = e
 	// Reset the current location.
-	h.base = loc
+	h.base = loc - int64(pos)
+	h.mu.Unlock()
+	h.publish(EventMark, e)
+}
+
+// Correct sets the current location to a preset value, without an encoder mark
+// having been seen e.g a quadrature encoder correcting the location between index marks.
+// The location is pos steps from the encoder index mark.
+func (h *Hand) Correct(loc int64, pos int) {
+	h.mu.Lock()
+	h.Corrections++
+	e := h.locationError(loc, pos)
+	h.base = loc - int64(pos)
+	h.mu.Unlock()
+	h.publish(EventCorrection, e)
+}
+
+// locationError returns the difference between the expected location of
+// the hand and a location pos steps from the index mark. Must be called with the lock held.
+func (h *Hand) locationError(loc int64, pos int) int {
+	e := int(loc-int64(pos)-h.base) % h.actual
+	if e > h.actual/2 {
+		e -= h.actual
+	} else if e < -h.actual/2 {
+		e += h.actual
+	}
+	return e
+}
+
+// Restore sets the steps per revolution, offset and current location of the hand
+// from a saved state.
+func (h *Hand) Restore(hs HandState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.actual = hs.Measured
+	h.offset = hs.Offset
+	h.base = h.mover.GetLocation() - int64(hs.Position)
+}
+
+// LastMark returns the number of marks seen, and the position error of the last mark.
+func (h *Hand) LastMark() (int, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.Marks, h.MarkError
 }
 
 // Calculate the current location of the hand.
 func (h *Hand) getCurrent() int {
-	return (int(h.mover.GetLocation()-h.base) + h.offset) % h.actual
+	c := (int(h.mover.GetLocation()-h.base) + h.offset) % h.actual
+	if c < 0 {
+		c += h.actual
+	}
+	return c
 }
 
 // Run starts the ticking of the hand.
 // The hand processing basically involves starting a ticker at the update
 // rate specified for the hand, and then moving the hand to match the step location
 // correlating to the time value the ticker sends.
-func (h *Hand) Run() {
+// Run returns nil when the hand is stopped, the context error when
+// the context is cancelled (abandoning any move in progress), or
+// errRecalibrate if a recalibration is requested, and
+// may be called again to restart the hand.
+func (h *Hand) Run(ctx context.Context) error {
+	if h.isStopped() {
+		return nil
+	}
 	// Get the step location corresponding to the current time.
-	target := h.target(time.Now())
+	target := h.target(h.ts.Now())
 	// Move the hand to the target location.
 	log.Printf("%s: Initial target %d, current %d", h.Name, target, h.getCurrent())
-	h.moveTo(target)
+	if err := h.tick(ctx, target); err != nil {
+		return err
+	}
 	// Attempt to start a Ticker on the update boundary so that the ticker
 	// ticks as close as possible on the exact time of the update interval.
-	h.syncTime()
-	ticker := time.NewTicker(h.update)
-	h.Ticking = true
+	if err := h.syncTime(ctx); err != nil || h.isStopped() {
+		return err
+	}
+	// Move the hand for the update boundary, as the ticker first ticks an update interval later.
+	if err := h.tick(ctx, h.target(h.ts.Now())); err != nil {
+		return err
+	}
+	ticker := h.ts.NewTicker(h.update)
+	defer ticker.Stop()
+	h.setTicking(true)
+	defer h.setTicking(false)
 	for {
 		// Receive the time from the ticker, and set the hand to the
 		// target position calculated from the current time.
-		h.moveTo(h.target(<-ticker.C))
+		select {
+		case t := <-ticker.C():
+			if err := h.tick(ctx, h.target(t)); err != nil {
+				return err
+			}
+		case <-h.wake:
+			if err := h.tick(ctx, h.target(h.ts.Now())); err != nil {
+				return err
+			}
+		case <-h.stop:
+			log.Printf("%s: Stopped", h.Name)
+			return nil
+		case <-ctx.Done():
+			log.Printf("%s: Stopped", h.Name)
+			return ctx.Err()
+		}
 	}
 }
 
+// tick moves the hand to the target position, unless the hand is paused.
+// If the hand is being parked, it is moved to the park position, and if
+// a recalibration has been requested, errRecalibrate is returned.
+func (h *Hand) tick(ctx context.Context, target int) error {
+	h.mu.Lock()
+	paused, parking, recal := h.paused, h.parking, h.recalibrate
+	h.parking = false
+	h.recalibrate = false
+	h.mu.Unlock()
+	if recal {
+		return errRecalibrate
+	}
+	if parking {
+		return h.parkHand(ctx)
+	}
+	if paused {
+		return nil
+	}
+	return h.moveTo(ctx, target)
+}
+
+// parkHand moves the hand to the park position.
+// Retrograde hands move directly to the position, other hands move clockwise.
+func (h *Hand) parkHand(ctx context.Context) error {
+	h.mu.Lock()
+	pos := int(math.Round(h.park * float64(h.actual) / 360))
+	st := pos - h.getCurrent()
+	if st < 0 && h.arc == 0 {
+		st += h.actual
+	}
+	h.mu.Unlock()
+	log.Printf("%s: Moving %d steps to park position", h.Name, st)
+	if st != 0 {
+		err := h.mover.Move(ctx, st)
+		h.publish(EventPosition, st)
+		return err
+	}
+	return nil
+}
+
 // Set the hand to the target position.
-// Always move clockwise, to avoid encoder getting confused.
-func (h *Hand) moveTo(target int) {
-	st := h.steps(target)
-	if st > 0 {
-		h.mover.Move(st)
+// Always move clockwise, to avoid encoder getting confused,
+// unless a retrograde hand is returning to the start of its arc.
+func (h *Hand) moveTo(ctx context.Context, target int) error {
+	st, ev := h.steps(target)
+	if ev != "" {
+		h.publish(ev, st)
 	}
+	if st != 0 {
+		err := h.mover.Move(ctx, st)
+		h.publish(EventPosition, st)
+		return err
+	}
+	return nil
 }
 
 // steps returns the number of steps to move
-// from the current position to the target position.
+// from the current position to the target position, and
+// the event to be published if the move is not a normal tick.
 // A small negative movement can arise if the steps per revolution is adjusted and the current location
 // is now slightly ahead of where it should be.
 // It is likely better to simply pause the hand to let time catch up;
 // the alternative is to fast-forward the hand to the target point.
-func (h *Hand) steps(target int) int {
+func (h *Hand) steps(target int) (int, string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	// Get difference between target and current location.
@@ -179,41 +497,101 @@ func (h *Hand) steps(target int) int {
 		if -st < h.skipMove {
 			h.Skipped++
 			log.Printf("%s: Skipping move (%d steps, %d current, %d target, %d actual)", h.Name, st, cur, target, h.actual)
-			return 0
+			return 0, EventSkip
+		}
+		if h.arc != 0 {
+			// Retrograde hand returns counter-clockwise.
+			h.Returned++
+			log.Printf("%s: Returning (%d steps, %d current, %d target)", h.Name, st, cur, target)
+			h.planned = ""
+			return st, EventReturn
 		}
 		// Convert backwards move to forward move around the clock.
 		st += h.actual
 	}
-	if st > h.skipMove {
+	ev := ""
+	// A move larger than a tick by more than the skip amount is a fast forward.
+	ff := h.skipMove + h.tickSteps
+	if st > ff && h.planned != "" {
+		log.Printf("%s: Planned fast forward for %s (%d steps, %d current, %d target)", h.Name, h.planned, st, cur, target)
+	} else if st > ff {
 		h.FastForward++
 		log.Printf("%s: Fast foward (%d steps, %d current, %d target, %d actual, %d base)", h.Name, st, cur, target, h.actual, h.base)
+		ev = EventFastForward
 	}
-	return st
+	h.planned = ""
+	return st, ev
 }
 
 // Calculate and determine the target step position of the hand
 // given the time and the current parameters of the hand (i.e
 // the measured number of steps in a revolution of the hand).
 func (h *Hand) target(t time.Time) int {
-	// Calculate milliseconds of day.
-	hour, minute, sec := t.Clock()
-	target := (hour % 12) * 60 * 60 * 1000
-	target += minute * 60 * 1000
-	target += sec * 1000
-	target += t.Nanosecond() / 1_000_000
-	mod := (target / h.divisor)
-	mt := mod % h.ticks
+	if _, ok := h.targeter.(absolute); !ok {
+		var shift time.Duration
+		t, shift = h.zone.local(t)
+		// Only report transitions that change the position of the hand.
+		if shift%h.targeter.Period() != 0 {
+			if shift > 0 {
+				log.Printf("%s: Daylight saving starts, moving forward %s", h.Name, shift)
+				h.mu.Lock()
+				h.planned = "daylight saving"
+				h.mu.Unlock()
+			} else {
+				log.Printf("%s: Daylight saving ends, holding hand for %s", h.Name, -shift)
+			}
+		}
+	}
+	mt, ticks := h.targeter.Target(t)
+	// Record the size of a tick, so that a normal tick of a hand with
+	// few ticks per revolution (e.g a date hand) is not seen as a fast forward.
+	h.mu.Lock()
+	h.tickSteps = int(int64(h.actual) / ticks)
+	if h.arc != 0 {
+		h.tickSteps = int(float64(h.tickSteps) * h.arc / 360)
+	}
+	// A hand that wraps to the start of the dial before the last tick (e.g a
+	// date hand at the end of a short month) moves forward past the unused ticks.
+	if mt == 0 && h.lastTick > 0 && h.lastTick < ticks-1 {
+		h.planned = "end of month"
+	}
+	h.lastTick = mt
+	h.mu.Unlock()
+	if h.arc != 0 {
+		// Scale the position to the arc of a retrograde hand.
+		return int(math.Round(float64(mt) * float64(h.actual) * h.arc / 360 / float64(ticks)))
+	}
 	// Round up.
-	return (mt*h.actual + h.ticks/2) / h.ticks
+	return int((mt*int64(h.actual) + ticks/2) / ticks)
 }
 
 // syncTime sleeps so that when the update interval Ticker is started, the
 // Ticker is aligned to the update time e.g if the update interval
 // of a hand is 10 seconds, then make sure the ticker is sending a tick
 // at 0, 10, 20 seconds (rather than 1, 11, 21...).
-func (h *Hand) syncTime() {
-	n := time.Now()
-	adj := time.Date(n.Year(), n.Month(), n.Day(), n.Hour(), n.Minute(), n.Second(), n.Nanosecond(), time.UTC)
+// Returns early if the hand is stopped, and returns an error if the context
+// is cancelled or a recalibration is requested while waiting.
+func (h *Hand) syncTime(ctx context.Context) error {
+	adj := h.zone.wall(h.ts.Now())
 	tr := adj.Truncate(h.update).Add(h.update)
-	time.Sleep(tr.Sub(adj))
+	synced := make(chan struct{})
+	go func() {
+		h.ts.Sleep(tr.Sub(adj))
+		close(synced)
+	}()
+	for {
+		select {
+		case <-synced:
+			return nil
+		case <-h.stop:
+			return nil
+		case <-h.wake:
+			// Act on a change of state while waiting.
+			if err := h.tick(ctx, h.target(h.ts.Now())); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
@@ -17,72 +17,168 @@
 package hand
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"html"
 	"image"
+	"image/color"
 	"image/jpeg"
 	"log"
 	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/fogleman/gg"
 )
 
-var clockface = flag.String("clockface", "clock-face.jpg", "Clock face JPEG file")
-var refresh = flag.Int("refresh", 10, "Refresh status page number of seconds")
+var clockface = flag.String("clockface", "clock-face.jpg", "Clock face JPEG file (the built-in face is used if not found)")
+var refresh = flag.Int("refresh", 0, "Refresh status page number of seconds (0 to update from the event stream)")
 
+// handDraw is the colour of a hand, and its length and
+// width as a fraction of the radius of the dial.
 type handDraw struct {
 	r      float64
 	g      float64
 	b      float64
-	length int
-	width  int
+	length float64
+	width  float64
 }
 
 var handMap map[string]handDraw = map[string]handDraw{
-	"hours":   {0, 0, 1, 400, 30},
-	"minutes": {0, 0, 1, 600, 10},
-	"seconds": {1, 0, 0, 600, 2},
+	"hours":   {0, 0, 1, 0.625, 0.047},
+	"minutes": {0, 0, 1, 0.94, 0.016},
+	"seconds": {1, 0, 0, 0.94, 0.003},
 }
 
+// energised is implemented by movers that track the time the motor is energised.
+type energised interface {
+	Energised() (time.Duration, time.Duration)
+}
+
+// Hands not found in handMap are drawn according to their kind.
+var kindMap map[string]handDraw = map[string]handDraw{
+	"weekday": {0, 0.5, 0, 0.39, 0.0125},
+	"date":    {0.5, 0, 0.5, 0.78, 0.006},
+	"month":   {0, 0.5, 0.5, 0.47, 0.0125},
+	"moon":    {0.5, 0.5, 0, 0.31, 0.019},
+	"tide":    {0, 0.3, 0.7, 0.55, 0.0125},
+}
+
+// Hands not found in either map are drawn in grey.
+var defaultHand = handDraw{0.3, 0.3, 0.3, 0.7, 0.01}
+
+// Geometry of the dial in the default clock face image.
 const midX = 641
 const midY = 646
+const faceRadius = 640
 
 // ClockServer starts a HTTP server that displays a clock face and
-// status information about the clock.
-func ClockServer(port int, clock []*Hand) {
-	inf, err := os.Open(*clockface)
+// status information about the clock. If f is nil, the image
+// from the clockface flag is used.
+// The server runs in the background, and is returned so that it can be shut down.
+func ClockServer(port int, clock []*Hand, f *Face) (*http.Server, error) {
+	img, g, err := loadFace(f)
 	if err != nil {
-		log.Fatalf("%s: %v", *clockface, err)
+		return nil, err
 	}
-	defer inf.Close()
-	img, _, err := image.Decode(inf)
+	url := fmt.Sprintf(":%d", port)
+	l, err := net.Listen("tcp", url)
 	if err != nil {
-		log.Fatalf("%s: %v", *clockface, err)
+		return nil, err
 	}
-	http.Handle("/clock.jpg", http.HandlerFunc(handler(clock, img)))
-	http.Handle("/status", http.HandlerFunc(status(clock)))
+	http.Handle("/clock.jpg", http.HandlerFunc(handler(clock, img, g)))
+	http.Handle("/clock.svg", http.HandlerFunc(svgHandler(clock)))
+	http.Handle("/clock.png", http.HandlerFunc(pngHandler(clock)))
+	http.Handle("/face.jpg", http.HandlerFunc(face(img)))
+	http.Handle("/events", http.HandlerFunc(events(clock)))
+	http.Handle("/status", http.HandlerFunc(status(clock, g)))
 	http.Handle("/adjust", http.HandlerFunc(adjust(clock)))
-	url := fmt.Sprintf(":%d", port)
+	http.Handle("/pause", http.HandlerFunc(command(clock, "Paused", (*Hand).Pause)))
+	http.Handle("/resume", http.HandlerFunc(command(clock, "Resumed", (*Hand).Resume)))
+	http.Handle("/park", http.HandlerFunc(command(clock, "Parked", (*Hand).Park)))
+	http.Handle(apiPrefix, http.HandlerFunc(apiHandler(clock)))
+	http.Handle("/metrics", http.HandlerFunc(metrics(clock)))
+	http.Handle(apiPrefix+"/", http.HandlerFunc(apiHandler(clock)))
 	log.Printf("Starting server on %s", url)
 	server := &http.Server{Addr: url}
-	log.Fatal(server.ListenAndServe())
+	// Event streams are ended when the server is shut down.
+	ctx, cancel := context.WithCancel(context.Background())
+	server.BaseContext = func(net.Listener) context.Context { return ctx }
+	server.RegisterOnShutdown(cancel)
+	go func() {
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			log.Printf("HTTP server: %v", err)
+		}
+	}()
+	return server, nil
+}
+
+// loadFace reads the clock face image, and determines the geometry of the dial.
+// If there is no image file, the built-in face is rendered instead.
+func loadFace(f *Face) (image.Image, geometry, error) {
+	if f == nil {
+		f = &Face{Image: *clockface, X: midX, Y: midY, Radius: faceRadius}
+	}
+	if f.Image == "" {
+		img, g := builtinFace()
+		return img, g, nil
+	}
+	inf, err := os.Open(f.Image)
+	if os.IsNotExist(err) {
+		log.Printf("%s not found, using built-in clock face", f.Image)
+		img, g := builtinFace()
+		return img, g, nil
+	}
+	if err != nil {
+		return nil, geometry{}, err
+	}
+	defer inf.Close()
+	img, _, err := image.Decode(inf)
+	if err != nil {
+		return nil, geometry{}, fmt.Errorf("%s: %v", f.Image, err)
+	}
+	// Default to a dial that fills the image.
+	b := img.Bounds()
+	g := geometry{f.X, f.Y, f.Radius}
+	if g.x == 0 || g.y == 0 {
+		g.x = float64(b.Min.X+b.Max.X) / 2
+		g.y = float64(b.Min.Y+b.Max.Y) / 2
+	}
+	if g.radius == 0 {
+		g.radius = math.Min(float64(b.Dx()), float64(b.Dy())) / 2 * 0.95
+	}
+	return img, g, nil
+}
+
+// builtinFace renders the built-in face. If it cannot be rendered, the image is nil,
+// so that the clock face images are unavailable rather than the whole server.
+func builtinFace() (image.Image, geometry) {
+	img, err := faceImage(nil, "", faceImageSize)
+	if err != nil {
+		log.Printf("Built-in clock face: %v", err)
+	}
+	return img, faceGeometry(faceImageSize)
 }
 
 // Display the clock face with the current location of the hands drawn upon it.
-func handler(clock []*Hand, img image.Image) func(http.ResponseWriter, *http.Request) {
+// The dial URL parameter selects which dial is displayed.
+func handler(clock []*Hand, img image.Image, g geometry) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if img == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		dial := r.FormValue("dial")
 		w.Header().Set("Content-Type", "image/jpeg")
 		c := gg.NewContextForImage(img)
-		for _, h := range clock {
-			hd, ok := handMap[h.Name]
-			if ok {
-				c.SetRGB(hd.r, hd.g, hd.b)
-				drawHand(c, h, hd.length, hd.width)
-			}
-		}
+		drawHands(&imagePainter{c: c}, g, clock, dial)
 		err := jpeg.Encode(w, c.Image(), nil)
 		if err != nil {
 			log.Printf("Error writing image: %v\n", err)
@@ -92,21 +188,76 @@ func handler(clock []*Hand, img image.Image) func(http.ResponseWriter, *http.Req
 	}
 }
 
-// Draw a hand onto the image using the requested length and width.
-// The positon of the hand is determined from the current physical hand location.
-func drawHand(c *gg.Context, h *Hand, length, width int) {
-	p, r, _ := h.Get()
-	p = r - p
-	radians := float64(p)*2*math.Pi/float64(r) + math.Pi
-	x := float64(length)*math.Sin(radians) + float64(midX)
-	y := float64(length)*math.Cos(radians) + float64(midY)
-	c.SetLineWidth(float64(width))
-	c.DrawLine(float64(midX), float64(midY), x, y)
-	c.Stroke()
+// Display the clock face without any hands, so that the
+// hands can be drawn by the browser.
+func face(img image.Image) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if img == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		if err := jpeg.Encode(w, img, nil); err != nil {
+			log.Printf("Error writing image: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
+
+// handStyle returns how the hand is to be drawn, looked up
+// by the name of the hand, and then by the kind of hand.
+// Any style set for the hand overrides the default.
+func handStyle(h *Hand) handDraw {
+	hd, ok := handMap[handName(h)]
+	if !ok {
+		hd, ok = kindMap[h.Kind()]
+	}
+	if !ok {
+		hd = defaultHand
+	}
+	if h.colour != nil {
+		r, g, b, _ := h.colour.RGBA()
+		hd.r, hd.g, hd.b = float64(r)/0xffff, float64(g)/0xffff, float64(b)/0xffff
+	}
+	if h.length != 0 {
+		hd.length = h.length
+	}
+	if h.width != 0 {
+		hd.width = h.width
+	}
+	return hd
+}
+
+// colour returns the colour of the hand.
+func (hd handDraw) colour() color.Color {
+	return color.RGBA{uint8(hd.r * 255), uint8(hd.g * 255), uint8(hd.b * 255), 255}
+}
+
+// handName returns the name of the hand without the dial name.
+func handName(h *Hand) string {
+	if h.Dial == "" {
+		return h.Name
+	}
+	return strings.TrimPrefix(h.Name, h.Dial+".")
+}
+
+// dials returns the names of the dials, in the order that they appear.
+func dials(clock []*Hand) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, h := range clock {
+		if !seen[h.Dial] {
+			seen[h.Dial] = true
+			names = append(names, h.Dial)
+		}
+	}
+	return names
 }
 
 // status displays the status of each hand of the clock.
-func status(clock []*Hand) func(http.ResponseWriter, *http.Request) {
+// The hands are drawn on the clock face by the browser, and the
+// page is updated from the event stream as the hands move.
+func status(clock []*Hand, g geometry) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		fmt.Fprintf(w, "<html><head>")
@@ -114,16 +265,133 @@ func status(clock []*Hand) func(http.ResponseWriter, *http.Request) {
 			fmt.Fprintf(w, "<meta http-equiv=\"refresh\" content=\"%d\">", *refresh)
 		}
 		fmt.Fprintf(w, "</head><body><h1>Status</h1>")
-		for _, h := range clock {
-			fmt.Fprintf(w, "%s: ", h.Name)
-			p, r, o := h.Get()
-			fmt.Fprintf(w, "position: %d offset: %d face size: %d (marks: %d, skipped: %d, fast-forwards %d, adjusted %d)<br>", p, o, r, h.Marks, h.Skipped, h.FastForward, h.Adjusted)
+		styles := make(map[string]statusHand)
+		for di, d := range dials(clock) {
+			if d != "" {
+				fmt.Fprintf(w, "<h2>%s</h2>", html.EscapeString(d))
+			}
+			for i, h := range clock {
+				if h.Dial != d {
+					continue
+				}
+				hd := handStyle(h)
+				styles[h.Name] = statusHand{
+					ID:     i,
+					Dial:   di,
+					Colour: svgColour(hd.colour()),
+					Length: hd.length * g.radius,
+					Width:  hd.width * g.radius,
+				}
+				st := h.Status()
+				fmt.Fprintf(w, "<span id=\"hand-%d\">%s (%s): ", i, html.EscapeString(h.Name), st.Kind)
+				if st.Paused {
+					fmt.Fprintf(w, "paused, ")
+				}
+				fmt.Fprintf(w, "position: %d offset: %d face size: %d (marks: %d, skipped: %d, fast-forwards %d, adjusted %d)</span><br>", st.Position, st.Offset, st.Measured, st.Marks, st.Skipped, st.FastForward, st.Adjusted)
+				if t, shift := h.Transition(); !t.IsZero() {
+					fmt.Fprintf(w, "&nbsp;&nbsp;next daylight saving change: %s (%+.1f hours)<br>", t.In(h.zone.loc).Format("Mon Jan 2 15:04 MST 2006"), shift.Hours())
+				}
+				if st.Confidence != 0 {
+					fmt.Fprintf(w, "&nbsp;&nbsp;calibration confidence: %.4f<br>", st.Confidence)
+				}
+				if e, ok := h.mover.(energised); ok {
+					on, total := e.Energised()
+					if total > 0 {
+						fmt.Fprintf(w, "&nbsp;&nbsp;motor energised: %s of %s (%.1f%%)<br>", on.Round(time.Second), total.Round(time.Second), float64(on)*100/float64(total))
+					}
+				}
+			}
+			fmt.Fprintf(w, "<p><canvas id=\"dial-%d\" data-dial=\"%d\" width=\"640\" height=\"640\"></canvas><br>", di, di)
+			fmt.Fprintf(w, "<a href=\"clock.jpg?dial=%s\">clock face</a>, <a href=\"clock.svg?dial=%s\">SVG</a><br>", url.QueryEscape(d), url.QueryEscape(d))
+		}
+		fmt.Fprintf(w, "<h2>Events</h2><ul id=\"events\"></ul>")
+		b, err := json.Marshal(styles)
+		if err != nil {
+			log.Printf("Status page: %v", err)
+		} else {
+			fmt.Fprintf(w, statusScript, b, g.x, g.y)
 		}
-		fmt.Fprintf(w, "<p><a href=\"clock.jpg\">clock face</a><br>")
 		fmt.Fprintf(w, "</body>")
 	}
 }
 
+// statusHand describes how the status page draws a hand.
+type statusHand struct {
+	ID     int     `json:"id"`   // Index of the hand
+	Dial   int     `json:"dial"` // Index of the dial
+	Colour string  `json:"colour"`
+	Length float64 `json:"length"` // Length in pixels of the face image
+	Width  float64 `json:"width"`
+}
+
+// statusScript draws the hands on the clock face, and updates
+// the status page from the event stream.
+const statusScript = `<script>
+var hands = %s;
+var mid = [%g, %g];
+var state = {};
+var face = new Image();
+function line(s) {
+	return s.name + " (" + s.kind + "): " + (s.paused ? "paused, " : "") +
+		"position: " + s.position + " offset: " + s.offset + " face size: " + s.measured +
+		" (marks: " + s.marks + ", skipped: " + s.skipped + ", fast-forwards " + s.fast_forward +
+		", adjusted " + s.adjusted + ")";
+}
+function draw(dial) {
+	var c = document.getElementById("dial-" + dial);
+	if (!c || !face.naturalWidth) {
+		return;
+	}
+	var x = c.getContext("2d");
+	var scale = c.width / face.naturalWidth;
+	x.setTransform(1, 0, 0, 1, 0, 0);
+	x.drawImage(face, 0, 0, c.width, c.height);
+	x.setTransform(scale, 0, 0, scale, 0, 0);
+	for (var n in state) {
+		var h = hands[n], s = state[n];
+		if (!h || h.dial != dial || !s.measured) {
+			continue;
+		}
+		var a = 2 * Math.PI * s.position / s.measured;
+		x.strokeStyle = h.colour;
+		x.lineWidth = h.width;
+		x.beginPath();
+		x.moveTo(mid[0], mid[1]);
+		x.lineTo(mid[0] + h.length * Math.sin(a), mid[1] - h.length * Math.cos(a));
+		x.stroke();
+	}
+}
+face.onload = function() {
+	var cs = document.getElementsByTagName("canvas");
+	for (var i = 0; i < cs.length; i++) {
+		cs[i].height = cs[i].width * face.naturalHeight / face.naturalWidth;
+		draw(cs[i].dataset.dial);
+	}
+};
+face.src = "face.jpg";
+var es = new EventSource("events");
+es.onmessage = function(m) {
+	var ev = JSON.parse(m.data), h = hands[ev.hand.name];
+	state[ev.hand.name] = ev.hand;
+	if (!h) {
+		return;
+	}
+	document.getElementById("hand-" + h.id).textContent = line(ev.hand);
+	draw(h.dial);
+	if (ev.type != "position") {
+		var list = document.getElementById("events");
+		var li = document.createElement("li");
+		li.textContent = new Date(ev.time).toLocaleTimeString() + " " + ev.hand.name + ": " + ev.type +
+			(ev.steps ? " (" + ev.steps + " steps)" : "");
+		list.insertBefore(li, list.firstChild);
+		while (list.childNodes.length > 20) {
+			list.removeChild(list.lastChild);
+		}
+	}
+};
+</script>
+`
+
 // adjust applies an adjustment to the hand offset.
 // URL parameters are hand=[name] adjust=[value]
 func adjust(clock []*Hand) func(http.ResponseWriter, *http.Request) {
@@ -164,3 +432,37 @@ func adjust(clock []*Hand) func(http.ResponseWriter, *http.Request) {
 		fmt.Fprintf(w, "</body>")
 	}
 }
+
+// command applies an operation such as pause or resume to a hand.
+// URL parameters are hand=[name], and if the hand is not
+// specified, the operation is applied to all the hands.
+func command(clock []*Hand, done string, op func(*Hand)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			log.Printf("Request error: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		hand := r.FormValue("hand")
+		var hands []*Hand
+		for _, h := range clock {
+			if hand == "" || h.Name == hand {
+				hands = append(hands, h)
+			}
+		}
+		if len(hands) == 0 {
+			log.Printf("Unknown hand: %s", hand)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<html><head>")
+		fmt.Fprintf(w, "</head><body>")
+		for _, h := range hands {
+			op(h)
+			fmt.Fprintf(w, "%s: %s<br>", h.Name, done)
+		}
+		fmt.Fprintf(w, "</body>")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Prometheus metrics for the clock hands.
+
+package hand
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// edgeCounter is implemented by encoders that count their input edges.
+type edgeCounter interface {
+	Edges() int64
+}
+
+// stepCounter is implemented by movers that count the motor steps moved.
+type stepCounter interface {
+	Stepped() int64
+}
+
+// metric is a single metric exported for each hand.
+type metric struct {
+	name  string
+	help  string
+	kind  string // gauge or counter
+	value func(h *Hand, st *HandStatus) (float64, bool)
+}
+
+var handMetrics = []metric{
+	{"clock_hand_measured_steps", "Measured steps per revolution.", "gauge",
+		func(h *Hand, st *HandStatus) (float64, bool) { return float64(st.Measured), true }},
+	{"clock_hand_position_steps", "Current position in steps from the top of the dial.", "gauge",
+		func(h *Hand, st *HandStatus) (float64, bool) { return float64(st.Position), true }},
+	{"clock_hand_ticking", "1 if the hand is ticking.", "gauge",
+		func(h *Hand, st *HandStatus) (float64, bool) { return boolValue(st.Ticking), true }},
+	{"clock_hand_paused", "1 if the hand is paused.", "gauge",
+		func(h *Hand, st *HandStatus) (float64, bool) { return boolValue(st.Paused), true }},
+	{"clock_hand_marks_total", "Number of encoder marks seen.", "counter",
+		func(h *Hand, st *HandStatus) (float64, bool) { return float64(st.Marks), true }},
+	{"clock_hand_corrections_total", "Number of location corrections between encoder marks.", "counter",
+		func(h *Hand, st *HandStatus) (float64, bool) { return float64(st.Corrections), true }},
+	{"clock_hand_skipped_total", "Number of skipped moves.", "counter",
+		func(h *Hand, st *HandStatus) (float64, bool) { return float64(st.Skipped), true }},
+	{"clock_hand_fast_forward_total", "Number of unplanned fast forward moves.", "counter",
+		func(h *Hand, st *HandStatus) (float64, bool) { return float64(st.FastForward), true }},
+	{"clock_hand_adjusted_total", "Number of offset adjustments.", "counter",
+		func(h *Hand, st *HandStatus) (float64, bool) { return float64(st.Adjusted), true }},
+	{"clock_hand_returned_total", "Number of retrograde returns.", "counter",
+		func(h *Hand, st *HandStatus) (float64, bool) { return float64(st.Returned), true }},
+	{"clock_hand_mark_error_steps", "Position error in steps when the last encoder mark was seen.", "gauge",
+		func(h *Hand, st *HandStatus) (float64, bool) { return float64(st.MarkError), st.Marks != 0 }},
+	{"clock_hand_calibration_seconds", "Duration of the last calibration.", "gauge",
+		func(h *Hand, st *HandStatus) (float64, bool) { return st.CalTime, st.CalTime != 0 }},
+	{"clock_hand_calibration_confidence", "Confidence in the last calibration measurement.", "gauge",
+		func(h *Hand, st *HandStatus) (float64, bool) { return st.Confidence, st.CalTime != 0 }},
+	{"clock_hand_motor_steps_total", "Number of motor steps moved.", "counter",
+		func(h *Hand, st *HandStatus) (float64, bool) {
+			if sc, ok := h.mover.(stepCounter); ok {
+				return float64(sc.Stepped()), true
+			}
+			return 0, false
+		}},
+	{"clock_hand_encoder_edges_total", "Number of encoder input edges seen.", "counter",
+		func(h *Hand, st *HandStatus) (float64, bool) {
+			if ec, ok := h.mover.(edgeCounter); ok {
+				return float64(ec.Edges()), true
+			}
+			return 0, false
+		}},
+	{"clock_hand_motor_energised_seconds_total", "Time the motor has been energised.", "counter",
+		func(h *Hand, st *HandStatus) (float64, bool) {
+			if e, ok := h.mover.(energised); ok {
+				on, _ := e.Energised()
+				return on.Seconds(), true
+			}
+			return 0, false
+		}},
+}
+
+// Escapes for label values.
+var labelEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metrics writes the metrics for each hand in the Prometheus text format.
+func metrics(clock []*Hand) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := make([]HandStatus, len(clock))
+		for i, h := range clock {
+			st[i] = h.Status()
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range handMetrics {
+			fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+			fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+			for i, h := range clock {
+				if v, ok := m.value(h, &st[i]); ok {
+					fmt.Fprintf(w, "%s{hand=\"%s\",dial=\"%s\"} %g\n", m.name, labelEscape.Replace(h.Name), labelEscape.Replace(h.Dial), v)
+				}
+			}
+		}
+	}
+}
+
+// boolValue converts a bool to a metric value.
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,268 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Quadrature encoder driver.
+
+package hand
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Number of counts of error allowed before the hand location is corrected.
+const quadTolerance = 2
+
+// Count change for each transition of the quadrature inputs, indexed
+// by the previous and current states of the inputs. Invalid transitions
+// (where both inputs have changed) are 0.
+var quadTable = [16]int64{0, 1, -1, 0, -1, 0, 0, 1, 1, 0, 0, -1, 0, -1, 1, 0}
+
+// Input event from one of the encoder channels.
+type quadEvent struct {
+	ch  int // 0 = A, 1 = B, 2 = index
+	val int
+}
+
+// QuadEncoder is a driver for a two channel quadrature encoder with
+// an index mark, used as an alternative to the interrupter Encoder.
+// The quadrature inputs provide a count of the actual position of
+// the hand relative to the index mark, which is compared to the
+// stepper location so that missed steps are detected and corrected continuously,
+// rather than only when the index mark is seen.
+// The index mark is a 0->1->0 transition, and as with the Encoder, the
+// trailing edge (when moving clockwise) is the reference point.
+type QuadEncoder struct {
+	Name      string
+	getStep   GetStep
+	syncer    Syncer
+	a, b      IO    // Quadrature inputs
+	index     IO    // Index mark input
+	cpr       int64 // Encoder counts per revolution of the hand
+	mu        sync.Mutex
+	measured  int        // Measured steps per revolution
+	count     int64      // Current encoder count
+	zero      int64      // Encoder count at the index mark
+	indexed   bool       // True once the index mark has been seen
+	lastIndex int64      // Stepper location of the index mark
+	riseStep  int64      // Stepper location at the rising edge of the index mark
+	riseCount int64      // Encoder count at the rising edge of the index mark
+	interval  []int      // History of raw measurements
+	errs      chan error // Failure of the encoder inputs
+	failed    bool       // Set once an input has failed
+	edges     int64      // Count of input edges
+	Corrected int        // Number of times the location has been corrected
+	Invalid   int        // Number of invalid transitions
+}
+
+// NewQuadEncoder creates a new QuadEncoder, with cpr counts for a
+// revolution of the hand.
+func NewQuadEncoder(name string, stepper GetStep, syncer Syncer, a, b, index IO, cpr int) *QuadEncoder {
+	q := new(QuadEncoder)
+	q.Name = name
+	q.getStep = stepper
+	q.syncer = syncer
+	q.a = a
+	q.b = b
+	q.index = index
+	q.cpr = int64(cpr)
+	q.errs = make(chan error, 3)
+	ev := make(chan quadEvent, 10)
+	for i, in := range []IO{a, b, index} {
+		go q.reader(i, in, ev)
+	}
+	go q.driver(ev)
+	return q
+}
+
+// Errors returns a channel that reports the failure of the encoder inputs.
+func (q *QuadEncoder) Errors() <-chan error {
+	return q.errs
+}
+
+// Location returns the current location as steps from the index mark,
+// as measured by the encoder.
+func (q *QuadEncoder) Location() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.location()
+}
+
+// Measured returns the measured steps per revolution.
+func (q *QuadEncoder) Measured() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.measured
+}
+
+// Intervals returns the history of measurements of the steps per revolution.
+func (q *QuadEncoder) Intervals() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]int(nil), q.interval...)
+}
+
+// Edges returns the number of input edges seen.
+func (q *QuadEncoder) Edges() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.edges
+}
+
+// ClearIntervals clears the history of measurements.
+func (q *QuadEncoder) ClearIntervals() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.interval = nil
+}
+
+// Seed initialises the encoder from a saved state, so that the encoder count
+// is correlated with the index mark before the index mark is seen.
+func (q *QuadEncoder) Seed(measured int, index int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.measured = measured
+	q.indexed = measured != 0
+	if q.indexed {
+		q.lastIndex = index
+		q.zero = q.count - (q.getStep.GetStep()-index)*q.cpr/int64(measured)
+	}
+}
+
+// location converts the current count to steps from the index mark.
+func (q *QuadEncoder) location() int {
+	c := (q.count - q.zero) % q.cpr
+	if c < 0 {
+		c += q.cpr
+	}
+	return int(c * int64(q.measured) / q.cpr)
+}
+
+// reader sends the input changes of one channel to the driver.
+// If the input fails, the failure is reported and the reader exits.
+func (q *QuadEncoder) reader(ch int, in IO, ev chan<- quadEvent) {
+	errCount := 0
+	for {
+		v, err := in.Get()
+		if err != nil {
+			if errCount++; errCount >= maxInputErrors {
+				log.Printf("%s: Quadrature input %d failed, no longer tracking hand: %v", q.Name, ch, err)
+				// Stop the driver from using the remaining inputs, as the count is no longer valid.
+				q.mu.Lock()
+				q.failed = true
+				q.mu.Unlock()
+				q.errs <- fmt.Errorf("%s: %w: input %d: %v", q.Name, ErrEncoder, ch, err)
+				return
+			}
+			log.Printf("%s: Quadrature input %d: %v", q.Name, ch, err)
+			time.Sleep(inputRetry)
+			continue
+		}
+		errCount = 0
+		ev <- quadEvent{ch, v}
+	}
+}
+
+// driver is the main goroutine for servicing the encoder.
+// The quadrature inputs are decoded to maintain the count, and
+// on each change the location from the count is compared with
+// the location derived from the stepper. If these differ by more than
+// the tolerance, the hand is resynchronised to the encoder location.
+// The steps per revolution is measured between successive index marks.
+// Once an input has failed, the events from the other inputs are discarded.
+func (q *QuadEncoder) driver(ev <-chan quadEvent) {
+	var state [3]int
+	for e := range ev {
+		prev := state[0]<<1 | state[1]
+		state[e.ch] = e.val
+		loc := q.getStep.GetStep()
+		q.mu.Lock()
+		if q.failed {
+			q.mu.Unlock()
+			continue
+		}
+		q.edges++
+		if e.ch == 2 {
+			q.mark(e.val, loc)
+			q.mu.Unlock()
+			continue
+		}
+		d := quadTable[prev<<2|(state[0]<<1|state[1])]
+		if d == 0 {
+			q.Invalid++
+			q.mu.Unlock()
+			continue
+		}
+		q.count += d
+		if !q.indexed || q.measured == 0 {
+			q.mu.Unlock()
+			continue
+		}
+		// Compare the stepper location since the index mark with
+		// the encoder location, and correct the hand if they differ.
+		pos := q.location()
+		steps := int((loc - q.lastIndex) % int64(q.measured))
+		if steps < 0 {
+			steps += q.measured
+		}
+		err := steps - pos
+		if err > q.measured/2 {
+			err -= q.measured
+		} else if err < -q.measured/2 {
+			err += q.measured
+		}
+		tol := quadTolerance * q.measured / int(q.cpr)
+		if err > tol || err < -tol {
+			q.Corrected++
+			log.Printf("%s: Correcting location by %d steps", q.Name, err)
+			q.lastIndex = loc - int64(pos)
+			if c, ok := q.syncer.(Corrector); ok {
+				c.Correct(loc, pos)
+			} else {
+				q.syncer.Mark(q.measured, loc, pos)
+			}
+		}
+		q.mu.Unlock()
+	}
+}
+
+// mark processes a change of the index input. Must be called with the lock held.
+func (q *QuadEncoder) mark(val int, loc int64) {
+	if val == 1 {
+		q.riseStep = loc
+		q.riseCount = q.count
+		return
+	}
+	ref, refCount := loc, q.count
+	if loc < q.riseStep {
+		// Moving counter-clockwise, so the reference edge is the rising edge.
+		ref, refCount = q.riseStep, q.riseCount
+	}
+	if q.indexed {
+		if n := refCount - q.zero; n >= q.cpr-quadTolerance || n <= -(q.cpr-quadTolerance) {
+			// A revolution has been completed, so measure the steps.
+			q.measured = int(diff(ref, q.lastIndex))
+			q.interval = addInterval(q.interval, q.measured)
+			log.Printf("%s: Index at %d (%d counts)", q.Name, q.measured, n)
+		}
+	}
+	q.zero = refCount
+	q.indexed = true
+	q.lastIndex = ref
+	if q.measured != 0 {
+		q.syncer.Mark(q.measured, ref, 0)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Acceleration and deceleration ramps for stepper moves.
+
+package hand
+
+// Ramp is an acceleration profile for moves. Moves start at the
+// stepper speed, accelerate to the maximum speed, and decelerate
+// back to the stepper speed at the end of the move.
+type Ramp struct {
+	Max   float64 // Maximum speed (RPM)
+	Accel float64 // Acceleration (RPM per second)
+	Curve bool    // Use an S-curve rather than a trapezoid
+}
+
+// segment is a part of a move at a single speed.
+type segment struct {
+	rpm   float64
+	steps int
+}
+
+// profile splits a move into segments that follow the ramp, starting and
+// ending at the start speed. steps is the steps in the move (negative for
+// counter-clockwise), and rev is the steps per revolution.
+func (r *Ramp) profile(start float64, steps, rev int) []segment {
+	dir := 1
+	if steps < 0 {
+		dir = -1
+		steps = -steps
+	}
+	acc := r.accelerate(start, rev)
+	peak := r.Max
+	if len(acc) > steps/2 {
+		// The move is too short to reach the maximum speed,
+		// so the hand decelerates from the midpoint.
+		acc = acc[:steps/2]
+		peak = start
+		if len(acc) > 0 {
+			peak = acc[len(acc)-1]
+		}
+	}
+	var segs []segment
+	for _, v := range acc {
+		segs = append(segs, segment{v, dir})
+	}
+	if cruise := steps - 2*len(acc); cruise > 0 {
+		segs = append(segs, segment{peak, cruise * dir})
+	}
+	for i := len(acc) - 1; i >= 0; i-- {
+		segs = append(segs, segment{acc[i], dir})
+	}
+	return segs
+}
+
+// accelerate returns the speed of each step while accelerating from the
+// start speed to the maximum speed. The profile is calculated in time, with
+// each step taking the time of the speed at the start of the step.
+// The S-curve eases in and out of the acceleration, and takes longer so that
+// the peak acceleration does not exceed the configured acceleration.
+func (r *Ramp) accelerate(start float64, rev int) []float64 {
+	var speeds []float64
+	dv := r.Max - start
+	if dv <= 0 || r.Accel <= 0 {
+		return nil
+	}
+	period := dv / r.Accel // Seconds to reach maximum speed
+	if r.Curve {
+		period *= 1.5
+	}
+	for t := 0.0; t < period; {
+		u := t / period
+		if r.Curve {
+			u = u * u * (3 - 2*u)
+		}
+		v := start + dv*u
+		speeds = append(speeds, v)
+		t += 60 / (v * float64(rev))
+	}
+	return speeds
+}
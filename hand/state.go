@@ -0,0 +1,94 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Saved state of the clock hands.
+
+package hand
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// HandState is the state of a hand saved on shutdown.
+type HandState struct {
+	Name     string `json:"name"`
+	Measured int    `json:"measured"` // Measured steps per revolution
+	Offset   int    `json:"offset"`   // Offset of hand at encoder mark
+	Position int    `json:"position"` // Location as steps from the encoder index mark
+}
+
+// State is the saved state of the clock.
+type State struct {
+	Saved time.Time   `json:"saved"`
+	Hands []HandState `json:"hands"`
+}
+
+// Find returns the saved state of the named hand.
+func (s *State) Find(name string) (HandState, bool) {
+	for _, hs := range s.Hands {
+		if hs.Name == name {
+			return hs, true
+		}
+	}
+	return HandState{}, false
+}
+
+// State returns the current state of the hand. If the encoder
+// mark has not been seen, the location is not known and false is returned.
+func (h *Hand) State() (HandState, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pos := int((h.mover.GetLocation() - h.base) % int64(h.actual))
+	if pos < 0 {
+		pos += h.actual
+	}
+	return HandState{Name: h.Name, Measured: h.actual, Offset: h.offset, Position: pos}, h.Marks != 0
+}
+
+// SaveState writes the state of the hands to the file. Hands
+// with an unknown location are not saved.
+// The file is written atomically so that a partially written file is never read.
+func SaveState(file string, hands []*Hand) error {
+	st := State{Saved: time.Now()}
+	for _, h := range hands {
+		if hs, ok := h.State(); ok {
+			st.Hands = append(st.Hands, hs)
+		}
+	}
+	b, err := json.MarshalIndent(&st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// LoadState reads the saved state of the hands from the file.
+func LoadState(file string) (*State, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	st := new(State)
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
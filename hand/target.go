@@ -0,0 +1,136 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Targeting strategies for hands.
+
+package hand
+
+import (
+	"fmt"
+	"time"
+)
+
+// Targeter determines where a hand should be for a given time.
+// The position is returned as a tick, and the number of ticks in
+// a revolution of the hand. The time provided is the wall clock time
+// of the hand's time zone, expressed as a UTC time.
+type Targeter interface {
+	Target(time.Time) (int64, int64)
+	Period() time.Duration // Nominal period of a revolution
+	Kind() string          // Kind of hand e.g clock, date
+}
+
+// targeters maps the kinds of hand to a function to create the Targeter.
+var targeters = map[string]func(*ClockConfig) (Targeter, error){
+	"clock":   func(hc *ClockConfig) (Targeter, error) { return NewClockTarget(hc.Period, hc.Update), nil },
+	"weekday": func(_ *ClockConfig) (Targeter, error) { return weekdayTarget{}, nil },
+	"date":    func(_ *ClockConfig) (Targeter, error) { return dateTarget{}, nil },
+	"month":   func(_ *ClockConfig) (Targeter, error) { return monthTarget{}, nil },
+	"moon":    newMoonTarget,
+	"tide":    newTideTarget,
+}
+
+// NewTargeter returns a Targeter for the kind of hand selected in the config.
+func NewTargeter(hc *ClockConfig) (Targeter, error) {
+	f, ok := targeters[hc.Type]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown hand type", hc.Type)
+	}
+	return f(hc)
+}
+
+// epoch is the reference time that the periods of hands are aligned to.
+// It is midnight on a Sunday, so that a 12 or 24 hour period starts
+// at midnight, and a week period starts at the start of Sunday.
+var epoch = time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)
+
+// clockTarget is the Targeter for a hand that revolves over a fixed period,
+// updating each update interval e.g a minute hand takes 60 minutes for a
+// revolution, and is updated every 5 seconds, so this hand has 720 ticks.
+type clockTarget struct {
+	period time.Duration
+	update time.Duration
+}
+
+// NewClockTarget returns a Targeter for a hand with a fixed period.
+// The position is the elapsed wall clock time within the period,
+// so any period (e.g 1 minute, 12 hours, 24 hours, 1 week) may be used.
+func NewClockTarget(period, update time.Duration) Targeter {
+	return &clockTarget{period: period, update: update}
+}
+
+func (c *clockTarget) Target(t time.Time) (int64, int64) {
+	pt := t.Sub(epoch) % c.period
+	if pt < 0 {
+		pt += c.period
+	}
+	return int64(pt / c.update), int64(c.period / c.update)
+}
+
+func (c *clockTarget) Period() time.Duration {
+	return c.period
+}
+
+func (c *clockTarget) Kind() string {
+	return "clock"
+}
+
+const day = 24 * time.Hour
+
+// weekdayTarget shows the day of the week, starting with Sunday.
+type weekdayTarget struct{}
+
+func (weekdayTarget) Target(t time.Time) (int64, int64) {
+	return int64(t.Weekday()), 7
+}
+
+func (weekdayTarget) Period() time.Duration {
+	return 7 * day
+}
+
+func (weekdayTarget) Kind() string {
+	return "weekday"
+}
+
+// dateTarget shows the day of the month on a dial of 31 days.
+// At the end of a shorter month, the hand moves forward past
+// the unused days to the 1st.
+type dateTarget struct{}
+
+func (dateTarget) Target(t time.Time) (int64, int64) {
+	return int64(t.Day() - 1), 31
+}
+
+func (dateTarget) Period() time.Duration {
+	return 31 * day
+}
+
+func (dateTarget) Kind() string {
+	return "date"
+}
+
+// monthTarget shows the month of the year.
+type monthTarget struct{}
+
+func (monthTarget) Target(t time.Time) (int64, int64) {
+	return int64(t.Month() - 1), 12
+}
+
+func (monthTarget) Period() time.Duration {
+	return 365 * day
+}
+
+func (monthTarget) Kind() string {
+	return "month"
+}
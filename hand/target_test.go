@@ -0,0 +1,133 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hand
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testMover records the moves of a hand.
+type testMover struct {
+	loc   int64
+	moves []int
+}
+
+func (m *testMover) Move(_ context.Context, n int) error {
+	m.loc += int64(n)
+	m.moves = append(m.moves, n)
+	return nil
+}
+
+func (m *testMover) GetLocation() int64 {
+	return m.loc
+}
+
+func TestDateMonthEnd(t *testing.T) {
+	m := &testMover{}
+	h := NewHand("date", RealTime, dateTarget{}, m, time.Hour, 3100, 0)
+	h.SetLocation(time.UTC, 0)
+	start := time.Date(2021, 2, 27, 0, 0, 0, 0, time.UTC)
+	h.moveTo(context.Background(), h.target(start))
+	m.moves = nil
+	ff := h.FastForward
+	for tm := start; tm.Before(time.Date(2021, 4, 2, 0, 0, 0, 0, time.UTC)); tm = tm.Add(time.Hour) {
+		h.moveTo(context.Background(), h.target(tm))
+	}
+	// 28 days in February, so the 1st of March skips 3 unused days.
+	expect := []int{100, 400}
+	for i := 0; i < 31; i++ {
+		expect = append(expect, 100)
+	}
+	if !reflect.DeepEqual(m.moves, expect) {
+		t.Errorf("moves %v, expected %v", m.moves, expect)
+	}
+	if h.FastForward != ff || h.Skipped != 0 {
+		t.Errorf("fast forward %d, skipped %d, expected none", h.FastForward-ff, h.Skipped)
+	}
+}
+
+func TestClockTarget(t *testing.T) {
+	for _, c := range []struct {
+		period, update time.Duration
+		t              time.Time
+		tick, ticks    int64
+	}{
+		{12 * time.Hour, time.Minute, time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), 0, 720},
+		{12 * time.Hour, time.Minute, time.Date(2021, 6, 1, 15, 30, 59, 0, time.UTC), 210, 720},
+		{24 * time.Hour, time.Minute, time.Date(2021, 6, 1, 15, 30, 0, 0, time.UTC), 930, 1440},
+		{time.Hour, 5 * time.Second, time.Date(2021, 6, 1, 15, 17, 0, 0, time.UTC), 204, 720},
+		// 2021-06-01 is a Tuesday, and a week starts at the start of Sunday.
+		{7 * day, time.Hour, time.Date(2021, 6, 1, 6, 0, 0, 0, time.UTC), 54, 168},
+	} {
+		tick, ticks := NewClockTarget(c.period, c.update).Target(c.t)
+		if tick != c.tick || ticks != c.ticks {
+			t.Errorf("%s/%s at %s: tick %d of %d, expected %d of %d", c.period, c.update, c.t, tick, ticks, c.tick, c.ticks)
+		}
+	}
+}
+
+func TestCalendarTarget(t *testing.T) {
+	for _, c := range []struct {
+		tg          Targeter
+		t           time.Time
+		tick, ticks int64
+	}{
+		{weekdayTarget{}, time.Date(2021, 6, 6, 12, 0, 0, 0, time.UTC), 0, 7},
+		{weekdayTarget{}, time.Date(2021, 6, 12, 23, 59, 0, 0, time.UTC), 6, 7},
+		{dateTarget{}, time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), 0, 31},
+		{dateTarget{}, time.Date(2021, 2, 28, 23, 59, 0, 0, time.UTC), 27, 31},
+		{dateTarget{}, time.Date(2021, 12, 31, 12, 0, 0, 0, time.UTC), 30, 31},
+		{monthTarget{}, time.Date(2021, 1, 31, 12, 0, 0, 0, time.UTC), 0, 12},
+		{monthTarget{}, time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC), 11, 12},
+		{&moonTarget{update: time.Hour}, newMoon, 0, 708},
+		{&moonTarget{update: time.Hour}, newMoon.Add(100*synodicMonth + synodicMonth/2), 354, 708},
+	} {
+		tick, ticks := c.tg.Target(c.t)
+		if tick != c.tick || ticks != c.ticks {
+			t.Errorf("%s at %s: tick %d of %d, expected %d of %d", c.tg.Kind(), c.t, tick, ticks, c.tick, c.ticks)
+		}
+	}
+}
+
+// TestVirtualCycle runs an hour hand through 12 hours of virtual time.
+func TestVirtualCycle(t *testing.T) {
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	vt := NewVirtualTime(start, 21600)
+	m := &testMover{}
+	h := NewHand("hours", vt, NewClockTarget(12*time.Hour, 10*time.Minute), m, 10*time.Minute, 1440, 0)
+	h.SetLocation(time.UTC, 0)
+	done := make(chan error)
+	go func() { done <- h.Run(context.Background()) }()
+	for vt.Now().Before(start.Add(12*time.Hour + 5*time.Minute)) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.Stop()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	total := 0
+	for _, n := range m.moves {
+		total += n
+	}
+	if total != 1440 {
+		t.Errorf("moved %d steps in 12 hours, expected 1440 (moves %v)", total, m.moves)
+	}
+	if h.FastForward != 0 || h.Skipped != 0 {
+		t.Errorf("fast forward %d, skipped %d, expected none", h.FastForward, h.Skipped)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Time sources for driving the hands.
+
+package hand
+
+import (
+	"time"
+)
+
+// TimeSource provides the current time and the timing services
+// used by a Hand, so that a hand may be driven by something other
+// than the wall clock.
+type TimeSource interface {
+	Now() time.Time
+	NewTicker(time.Duration) Ticker
+	Sleep(time.Duration)
+}
+
+// Ticker delivers periodic ticks from a TimeSource.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealTime is a TimeSource that uses the system clock.
+var RealTime TimeSource = realTime{}
+
+type realTime struct{}
+
+func (realTime) Now() time.Time {
+	return time.Now()
+}
+
+func (realTime) NewTicker(d time.Duration) Ticker {
+	return &realTicker{time.NewTicker(d)}
+}
+
+func (realTime) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (r *realTicker) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r *realTicker) Stop() {
+	r.t.Stop()
+}
+
+// VirtualTime is a TimeSource that starts at a selected time and
+// runs at a multiple of real time, so that e.g a full 12 hour
+// revolution of a hand can be run in a matter of seconds.
+type VirtualTime struct {
+	start time.Time // Virtual time at creation
+	base  time.Time // Real time at creation
+	rate  float64   // Multiplier of real time
+}
+
+// NewVirtualTime creates a VirtualTime starting at start, and
+// running at rate times real time.
+func NewVirtualTime(start time.Time, rate float64) *VirtualTime {
+	return &VirtualTime{start: start, base: time.Now(), rate: rate}
+}
+
+// Now returns the current virtual time.
+func (v *VirtualTime) Now() time.Time {
+	return v.start.Add(time.Duration(float64(time.Since(v.base)) * v.rate))
+}
+
+// NewTicker returns a Ticker that ticks every d of virtual time.
+// As with time.Ticker, ticks are dropped if the receiver falls behind.
+func (v *VirtualTime) NewTicker(d time.Duration) Ticker {
+	t := &virtualTicker{c: make(chan time.Time, 1), done: make(chan struct{})}
+	t.t = time.NewTicker(v.scale(d))
+	go func() {
+		for {
+			select {
+			case <-t.t.C:
+				select {
+				case t.c <- v.Now():
+				default:
+				}
+			case <-t.done:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// Sleep pauses for d of virtual time.
+func (v *VirtualTime) Sleep(d time.Duration) {
+	time.Sleep(v.scale(d))
+}
+
+// scale converts a virtual duration to a real duration.
+func (v *VirtualTime) scale(d time.Duration) time.Duration {
+	r := time.Duration(float64(d) / v.rate)
+	if r <= 0 {
+		r = 1
+	}
+	return r
+}
+
+type virtualTicker struct {
+	t    *time.Ticker
+	c    chan time.Time
+	done chan struct{}
+}
+
+func (t *virtualTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *virtualTicker) Stop() {
+	t.t.Stop()
+	close(t.done)
+}
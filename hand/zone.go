@@ -0,0 +1,150 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Time zone and daylight saving handling.
+
+package hand
+
+import (
+	"sync"
+	"time"
+)
+
+// How far either side of the current time to search for zone transitions.
+const searchSpan = 366 * 24 * time.Hour
+
+// Search interval when scanning for zone transitions.
+const searchStep = 12 * time.Hour
+
+// zone tracks the time zone of a hand, and the daylight saving
+// transitions either side of the current time.
+// When the zone offset falls back, the hand is held at the time of the
+// transition until the wall clock catches up again, rather than moving
+// the hand almost a full revolution. When the offset springs forward,
+// the hand is fast-forwarded as normal.
+type zone struct {
+	mu        sync.Mutex
+	loc       *time.Location
+	period    time.Duration // Period of the hand
+	shift     time.Duration // Offset added to the displayed time
+	lo, hi    time.Time     // Range over which prev and next are valid
+	prev      time.Time     // Previous transition (zero if none)
+	prevShift time.Duration // Offset change at previous transition
+	next      time.Time     // Next transition (zero if none)
+	nextShift time.Duration // Offset change at next transition
+	last      time.Time     // Time of the last call to local
+}
+
+func newZone(loc *time.Location, period time.Duration) *zone {
+	return &zone{loc: loc, period: period}
+}
+
+// local returns the wall clock time that the hand should display at time t,
+// and the offset change of any transition that has been crossed since the last call.
+// The wall clock time is returned as a UTC time so that the shift can be applied
+// without crossing any further transitions.
+func (z *zone) local(t time.Time) (time.Time, time.Duration) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	var crossed time.Duration
+	if !z.last.IsZero() && !z.next.IsZero() && z.last.Before(z.next) && !t.Before(z.next) {
+		crossed = z.nextShift
+	}
+	z.last = t
+	z.update(t)
+	if z.prevShift < 0 {
+		// Offset has fallen back, so hold the hand until the
+		// wall clock returns to where it was at the transition.
+		// If the change is a multiple of the hand's period, the hand
+		// is unaffected and can keep moving.
+		hold := (-z.prevShift) % z.period
+		if hold != 0 && t.Before(z.prev.Add(hold)) {
+			return z.wall(z.prev.Add(-time.Nanosecond)), crossed
+		}
+	}
+	return z.wall(t), crossed
+}
+
+// wall returns the shifted wall clock time of t in the zone, as a UTC time.
+func (z *zone) wall(t time.Time) time.Time {
+	l := t.In(z.loc)
+	w := time.Date(l.Year(), l.Month(), l.Day(), l.Hour(), l.Minute(), l.Second(), l.Nanosecond(), time.UTC)
+	return w.Add(z.shift)
+}
+
+// upcoming returns the next transition after t and the change in offset,
+// or a zero time if there is no transition within the search span.
+func (z *zone) upcoming(t time.Time) (time.Time, time.Duration) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.update(t)
+	return z.next, z.nextShift
+}
+
+// update refreshes the transitions either side of t if
+// t is outside of the range of the last search.
+func (z *zone) update(t time.Time) {
+	if !z.lo.IsZero() && !t.Before(z.lo) && t.Before(z.hi) {
+		return
+	}
+	var ok bool
+	z.prev, z.prevShift, ok = transition(z.loc, t, -searchSpan)
+	if ok {
+		z.lo = z.prev
+	} else {
+		z.lo = t.Add(-searchSpan)
+	}
+	z.next, z.nextShift, ok = transition(z.loc, t, searchSpan)
+	if ok {
+		z.hi = z.next
+	} else {
+		z.hi = t.Add(searchSpan)
+	}
+}
+
+// transition searches from t across span (which is negative to search backwards)
+// for a change in the zone offset. The time of the first instant having
+// the new offset is returned, along with the change in offset.
+func transition(loc *time.Location, t time.Time, span time.Duration) (time.Time, time.Duration, bool) {
+	step := searchStep
+	if span < 0 {
+		step = -step
+		span = -span
+	}
+	_, off := t.In(loc).Zone()
+	for d := time.Duration(0); d < span; d += searchStep {
+		a := t.Add(step)
+		_, o := a.In(loc).Zone()
+		if o != off {
+			early, late := t, a
+			if step < 0 {
+				early, late = a, t
+			}
+			_, eOff := early.In(loc).Zone()
+			_, lOff := late.In(loc).Zone()
+			// Bisect to find the exact instant of the change.
+			for late.Sub(early) > 1 {
+				mid := early.Add(late.Sub(early) / 2)
+				if _, m := mid.In(loc).Zone(); m == eOff {
+					early = mid
+				} else {
+					late = mid
+				}
+			}
+			return late, time.Duration(lOff-eOff) * time.Second, true
+		}
+		t = a
+	}
+	return time.Time{}, 0, false
+}
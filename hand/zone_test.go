@@ -0,0 +1,152 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hand
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// Daylight saving in London ends at 01:00 UTC on 2021-10-31,
+// and starts at 01:00 UTC on 2022-03-27.
+var (
+	fallBack      = time.Date(2021, 10, 31, 1, 0, 0, 0, time.UTC)
+	springForward = time.Date(2022, 3, 27, 1, 0, 0, 0, time.UTC)
+)
+
+func london(t *testing.T) *time.Location {
+	loc, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatalf("Europe/London: %v", err)
+	}
+	return loc
+}
+
+func TestTransition(t *testing.T) {
+	loc := london(t)
+	for _, c := range []struct {
+		from  time.Time
+		span  time.Duration
+		at    time.Time
+		shift time.Duration
+	}{
+		{fallBack.Add(-20 * time.Hour), searchSpan, fallBack, -time.Hour},
+		{fallBack.Add(30 * day), -searchSpan, fallBack, -time.Hour},
+		{fallBack.Add(time.Hour), searchSpan, springForward, time.Hour},
+		{springForward.Add(time.Nanosecond), -searchSpan, springForward, time.Hour},
+	} {
+		at, shift, ok := transition(loc, c.from, c.span)
+		if !ok || !at.Equal(c.at) || shift != c.shift {
+			t.Errorf("from %s: transition at %s (%s, %v), expected %s (%s)", c.from, at, shift, ok, c.at, c.shift)
+		}
+	}
+	if _, _, ok := transition(time.UTC, fallBack, searchSpan); ok {
+		t.Errorf("UTC has a transition")
+	}
+}
+
+func TestZoneFallBack(t *testing.T) {
+	z := newZone(london(t), 12*time.Hour)
+	for _, c := range []struct {
+		t       time.Time
+		wall    time.Time
+		crossed time.Duration
+	}{
+		{fallBack.Add(-30 * time.Minute), time.Date(2021, 10, 31, 1, 30, 0, 0, time.UTC), 0},
+		// Held at the last instant before the transition for an hour.
+		{fallBack, time.Date(2021, 10, 31, 1, 59, 59, 999999999, time.UTC), -time.Hour},
+		{fallBack.Add(59 * time.Minute), time.Date(2021, 10, 31, 1, 59, 59, 999999999, time.UTC), 0},
+		{fallBack.Add(time.Hour), time.Date(2021, 10, 31, 2, 0, 0, 0, time.UTC), 0},
+	} {
+		wall, crossed := z.local(c.t)
+		if !wall.Equal(c.wall) || crossed != c.crossed {
+			t.Errorf("%s: wall %s (crossed %s), expected %s (%s)", c.t, wall, crossed, c.wall, c.crossed)
+		}
+	}
+	// A change of a whole period does not hold the hand.
+	z = newZone(london(t), time.Hour)
+	z.local(fallBack.Add(-time.Minute))
+	wall, crossed := z.local(fallBack)
+	if want := time.Date(2021, 10, 31, 1, 0, 0, 0, time.UTC); !wall.Equal(want) || crossed != -time.Hour {
+		t.Errorf("minute hand: wall %s (crossed %s), expected %s", wall, crossed, want)
+	}
+}
+
+func TestZoneSpringForward(t *testing.T) {
+	z := newZone(london(t), 12*time.Hour)
+	for _, c := range []struct {
+		t       time.Time
+		wall    time.Time
+		crossed time.Duration
+	}{
+		{springForward.Add(-time.Minute), time.Date(2022, 3, 27, 0, 59, 0, 0, time.UTC), 0},
+		{springForward, time.Date(2022, 3, 27, 2, 0, 0, 0, time.UTC), time.Hour},
+		{springForward.Add(time.Minute), time.Date(2022, 3, 27, 2, 1, 0, 0, time.UTC), 0},
+	} {
+		wall, crossed := z.local(c.t)
+		if !wall.Equal(c.wall) || crossed != c.crossed {
+			t.Errorf("%s: wall %s (crossed %s), expected %s (%s)", c.t, wall, crossed, c.wall, c.crossed)
+		}
+	}
+}
+
+// runHours moves an hour hand each minute from start for the duration,
+// and returns the moves made after the hand is first positioned.
+func runHours(t *testing.T, start time.Time, d time.Duration) (*Hand, []int) {
+	m := &testMover{}
+	h := NewHand("hours", RealTime, NewClockTarget(12*time.Hour, time.Minute), m, time.Minute, 1440, 0)
+	h.SetLocation(london(t), 0)
+	h.moveTo(context.Background(), h.target(start))
+	m.moves = nil
+	h.FastForward = 0
+	for tm := start.Add(time.Minute); !tm.After(start.Add(d)); tm = tm.Add(time.Minute) {
+		h.moveTo(context.Background(), h.target(tm))
+	}
+	return h, m.moves
+}
+
+func TestHandFallBack(t *testing.T) {
+	h, moves := runHours(t, fallBack.Add(-time.Hour), 3*time.Hour)
+	// One tick each minute, with the hand held for the hour after the transition.
+	var expect []int
+	for i := 0; i < 120; i++ {
+		expect = append(expect, 2)
+	}
+	if !reflect.DeepEqual(moves, expect) {
+		t.Errorf("moves %v, expected %v", moves, expect)
+	}
+	if h.FastForward != 0 || h.Skipped != 0 {
+		t.Errorf("fast forward %d, skipped %d, expected none", h.FastForward, h.Skipped)
+	}
+}
+
+func TestHandSpringForward(t *testing.T) {
+	h, moves := runHours(t, springForward.Add(-time.Hour), 2*time.Hour)
+	// One tick each minute, with a planned move of an hour and a tick at the transition.
+	var expect []int
+	for i := 0; i < 120; i++ {
+		expect = append(expect, 2)
+	}
+	expect[59] = 122
+	if !reflect.DeepEqual(moves, expect) {
+		t.Errorf("moves %v, expected %v", moves, expect)
+	}
+	if h.FastForward != 0 || h.Skipped != 0 {
+		t.Errorf("fast forward %d, skipped %d, expected none", h.FastForward, h.Skipped)
+	}
+}
@@ -17,9 +17,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
+	"log"
 	"strings"
 	"time"
 
@@ -62,9 +64,16 @@ var params = []struct {
 const threshold = time.Millisecond * 50
 
 var port = flag.Int("port", 8080, "Web server port number")
+var rate = flag.Float64("rate", 1.0, "Rate of simulated time as a multiple of real time")
+
+// Source of time for the simulated hands.
+var ts hand.TimeSource = hand.RealTime
 
 func main() {
 	flag.Parse()
+	if *rate != 1.0 {
+		ts = hand.NewVirtualTime(time.Now(), *rate)
+	}
 	var hands []*SimHand
 	for i := range params {
 		hands = append(hands, sim(i))
@@ -72,7 +81,7 @@ func main() {
 	for {
 		ready := 0
 		for _, s := range hands {
-			if s.hand.Ticking {
+			if s.hand.Status().Ticking {
 				ready++
 			}
 		}
@@ -87,7 +96,9 @@ func main() {
 	for _, sh := range hands {
 		clk = append(clk, sh.hand)
 	}
-	go hand.ClockServer(*port, clk)
+	if _, err := hand.ClockServer(*port, clk, nil); err != nil {
+		log.Fatalf("%v", err)
+	}
 	for {
 		var b strings.Builder
 		var val [3]int
@@ -95,11 +106,13 @@ func main() {
 			val[i] = h.Pos(&b, params[i].units)
 			fmt.Fprintf(&b, ":")
 		}
-		now := time.Now()
+		now := ts.Now()
 		rt := time.Date(now.Year(), now.Month(), now.Day(), now.Hour()%12, now.Minute(), now.Second(), 0, time.Local)
 		myt := time.Date(now.Year(), now.Month(), now.Day(), val[0], val[1], val[2], 0, time.Local)
 		diff := myt.Sub(rt)
-		if diff > threshold || diff < -threshold {
+		// Allow for the hands lagging the accelerated time.
+		limit := time.Duration(float64(threshold) * *rate)
+		if diff > limit || diff < -limit {
 			fmt.Printf("%s - diff is %s\n", b.String(), diff.String())
 		}
 		time.Sleep(time.Second * 5)
@@ -126,9 +139,13 @@ func sim(index int) *SimHand {
 	sh.perstep = p.perstep
 	sh.edge1 = p.edge1
 	sh.edge2 = p.edge2
-	sh.hand = hand.NewHand(p.name, p.period, sh, p.update, p.reference, p.offset)
-	sh.encoder = hand.NewEncoder(p.name, sh, sh.hand, sh, (p.edge2-p.edge1+1)/2)
-	go hand.Calibrate(true, sh.encoder, sh.hand, p.reference)
+	sh.hand = hand.NewHand(p.name, ts, hand.NewClockTarget(p.period, p.update), sh, p.update, p.reference, p.offset)
+	sh.encoder = hand.NewEncoder(p.name, sh, sh.hand, sh, (p.edge2-p.edge1+1)/2, 1, 0)
+	go func() {
+		if err := hand.Calibrate(context.Background(), true, sh.encoder, sh.hand, p.reference, hand.Calibration{}); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}()
 	return sh
 }
 
@@ -138,7 +155,7 @@ func sim(index int) *SimHand {
 // simulate a hand revolution that's not exactly an integral size.
 // The idea is that the encoder will correct the revolution size
 // so that errors do not build up.
-func (s *SimHand) Move(steps int) {
+func (s *SimHand) Move(ctx context.Context, steps int) error {
 	var e1, e2 int
 	var sInc int64
 	var inc float64
@@ -167,6 +184,7 @@ func (s *SimHand) Move(steps int) {
 		time.Sleep(time.Microsecond * 20)
 		//time.Sleep(time.Millisecond)
 	}
+	return nil
 }
 
 // GetLocation returns the current step location
@@ -18,6 +18,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -46,15 +47,18 @@ func main() {
 		log.Fatalf("ClockHand: %s %v", *section, err)
 	}
 	defer clk.Close()
-	hand.Calibrate(false, clk.Encoder, clk.Hand, clk.Config.Steps)
+	ctx := context.Background()
+	if err := hand.Calibrate(ctx, false, clk.Encoder, clk.Hand, clk.Config.Steps, clk.Config.Calibration); err != nil {
+		log.Fatalf("%v", err)
+	}
 	reader := bufio.NewReader(os.Stdin)
 	enc := clk.Encoder
 	var steps int
-	measured := enc.Measured
+	measured := enc.Measured()
 	current := enc.Location()
 	steps = diff(measured-hc.Offset, current, measured)
 	fmt.Printf("Moving to midnight position (%d steps, %d current, %d offset)\n", steps, current, hc.Offset)
-	clk.Move(steps)
+	clk.Move(ctx, steps)
 	current = (current + steps) % measured
 	for {
 		fmt.Printf("Location %d (size %d) - offset is %d\n", current, measured, measured-current)
@@ -71,7 +75,7 @@ func main() {
 		case "o":
 			fmt.Printf("Move to original midnight (%d) from %d\n", hc.Offset, current)
 			steps = hc.Offset - current
-			clk.Move(steps)
+			clk.Move(ctx, steps)
 			current = (current + steps) % measured
 		default:
 			n, err := fmt.Sscanf(text, "%d", &steps)
@@ -79,7 +83,7 @@ func main() {
 				fmt.Printf("Unrecognised input\n")
 			} else {
 				fmt.Printf("Moving %d steps\n", steps)
-				clk.Move(steps)
+				clk.Move(ctx, steps)
 				current = (current + steps) % measured
 			}
 		}